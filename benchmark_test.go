@@ -0,0 +1,207 @@
+package tgod
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-tgod/tgod/talpa"
+	"github.com/go-tgod/tgod/tieba"
+	"github.com/go-tgod/tgod/tieba/tiebatest"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 每个贴吧 20 个帖子, 每个帖子 3 页回帖, 完整抓取一个贴吧需要 61 个请求
+var benchOptions = tiebatest.Options{Threads: 20, Pages: 3, Posts: 30, SubPosts: 2}
+
+const benchForums = 4
+
+// 将请求发送到模拟服务器的下载器中间件
+type redirectMiddleware struct {
+	talpa.BaseDownloaderMiddleware
+	srv *tiebatest.Server
+}
+
+func (m redirectMiddleware) ProcessRequest(req *gen.Request) (*gen.Response, error) {
+	m.srv.Redirect(req)
+	return nil, nil
+}
+
+// 只计数的数据处理管道, 不需要数据库
+type countPipeline struct {
+	items int64
+}
+
+func (p *countPipeline) Open()  {}
+func (p *countPipeline) Close() {}
+func (p *countPipeline) ProcessItem(item talpa.Item) (talpa.Item, error) {
+	atomic.AddInt64(&p.items, 1)
+	return item, nil
+}
+
+// 使用固定的分页设置, 不受其他测试修改的全局配置影响
+func benchSpiders() []*TiebaSpider {
+	spiders := make([]*TiebaSpider, benchForums)
+	for i := range spiders {
+		forum := fmt.Sprintf("forum%d", i)
+		settings := SpiderSettings(forum)
+		settings.Set("threadPaginate", tieba.MaxThreadNum)
+		settings.Set("postPaginate", tieba.MaxPostNum)
+		settings.Set("maxPagesPerThread", 0)
+		spiders[i] = NewTiebaSpiderWithSettings(forum, settings)
+	}
+	return spiders
+}
+
+func quietLoggers() func() {
+	levels := []logrus.Level{Logger.Level, talpa.Logger.Level, tieba.Logger.Level}
+	Logger.Level, talpa.Logger.Level, tieba.Logger.Level = logrus.WarnLevel, logrus.WarnLevel, logrus.WarnLevel
+	return func() {
+		Logger.Level, talpa.Logger.Level, tieba.Logger.Level = levels[0], levels[1], levels[2]
+	}
+}
+
+// 使用 Crawler 抓取所有贴吧, 返回抓取的数据数量
+func crawlOffline(srv *tiebatest.Server, rs talpa.RequestScheduler) (*talpa.Crawler, int64, error) {
+	spiders := make([]talpa.Spider, 0, benchForums)
+	for _, s := range benchSpiders() {
+		spiders = append(spiders, s)
+	}
+	crawler := talpa.NewCrawler(spiders, rs, talpa.NewDownloader(8), talpa.NewJobScheduler(10), talpa.NewScraper(8))
+	crawler.UseDownloaderMiddleware(redirectMiddleware{srv: srv})
+	p := new(countPipeline)
+	crawler.UsePipeline(p)
+	err := crawler.Run(context.Background())
+	return crawler, atomic.LoadInt64(&p.items), err
+}
+
+// 顺序抓取时直接处理请求和数据
+type sequentialHelper struct {
+	reqs  []*gen.Request
+	items int64
+	stats *talpa.Stats
+}
+
+func (h *sequentialHelper) PutRequest(reqs ...*gen.Request) {
+	h.reqs = append(h.reqs, reqs...)
+}
+func (h *sequentialHelper) PutItem(items ...talpa.Item) {
+	h.items += int64(len(items))
+}
+func (h *sequentialHelper) PutJob(jobs ...func()) {
+	for _, job := range jobs {
+		job()
+	}
+}
+func (h *sequentialHelper) Stats() *talpa.Stats {
+	return h.stats
+}
+
+// 不经过 Crawler 依次发送请求并执行回调, 返回抓取的数据数量
+func crawlSequentially(srv *tiebatest.Server) (int64, error) {
+	h := &sequentialHelper{stats: talpa.NewStats()}
+	for _, spider := range benchSpiders() {
+		h.reqs = spider.StartRequests()
+		for len(h.reqs) > 0 {
+			req := h.reqs[0]
+			h.reqs = h.reqs[1:]
+			res, err := srv.Redirect(req).Do()
+			if err != nil {
+				return 0, err
+			}
+			talpa.MetaOf(req).CallBack(res, h)
+		}
+	}
+	return h.items, nil
+}
+
+func TestCrawlerOffline(t *testing.T) {
+	defer quietLoggers()()
+	srv := tiebatest.NewServer(benchOptions)
+	defer srv.Close()
+
+	crawler, items, err := crawlOffline(srv, talpa.NewFairRequestScheduler(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := int64(benchForums * srv.RequestsPerForum())
+	if n := srv.NumRequests(); n != expected {
+		t.Errorf("%d requests were sent, %d expected", n, expected)
+	}
+	seqItems, err := crawlSequentially(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items != seqItems || items == 0 {
+		t.Errorf("%d items were scraped by crawler, %d by sequential crawl", items, seqItems)
+	}
+	if sent := crawler.Stats().Counters[talpa.StatsRequestSent]; sent != expected {
+		t.Errorf("Stats of sent requests is %d, %d expected", sent, expected)
+	}
+}
+
+var benchLatencies = []time.Duration{0, 2 * time.Millisecond}
+
+// 报告吞吐量和每次抓取消耗的CPU时间
+func reportCrawl(b *testing.B, srv *tiebatest.Server, start time.Time, cpuStart time.Duration) {
+	elapsed := time.Since(start)
+	b.ReportMetric(float64(srv.NumRequests())/elapsed.Seconds(), "req/s")
+	b.ReportMetric(float64(cpuTime()-cpuStart)/float64(time.Millisecond)/float64(b.N), "cpu-ms/op")
+}
+
+// 顺序抓取作为性能比较的基准
+func BenchmarkTiebaSequentially(b *testing.B) {
+	defer quietLoggers()()
+	for _, latency := range benchLatencies {
+		b.Run(latency.String(), func(b *testing.B) {
+			opts := benchOptions
+			opts.Latency = latency
+			srv := tiebatest.NewServer(opts)
+			defer srv.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			start, cpuStart := time.Now(), cpuTime()
+			for i := 0; i < b.N; i++ {
+				if _, err := crawlSequentially(srv); err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportCrawl(b, srv, start, cpuStart)
+		})
+	}
+}
+
+func BenchmarkTiebaCrawler(b *testing.B) {
+	defer quietLoggers()()
+	schedulers := []struct {
+		name string
+		new  func() talpa.RequestScheduler
+	}{
+		{"Priority", func() talpa.RequestScheduler { return talpa.NewRequestScheduler(10) }},
+		{"Fair", func() talpa.RequestScheduler { return talpa.NewFairRequestScheduler(10) }},
+	}
+	for _, latency := range benchLatencies {
+		for _, scheduler := range schedulers {
+			b.Run(scheduler.name+"/"+latency.String(), func(b *testing.B) {
+				opts := benchOptions
+				opts.Latency = latency
+				srv := tiebatest.NewServer(opts)
+				defer srv.Close()
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				start, cpuStart := time.Now(), cpuTime()
+				for i := 0; i < b.N; i++ {
+					if _, _, err := crawlOffline(srv, scheduler.new()); err != nil {
+						b.Fatal(err)
+					}
+				}
+				reportCrawl(b, srv, start, cpuStart)
+			})
+		}
+	}
+}
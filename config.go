@@ -1,6 +1,14 @@
 package tgod
 
 import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/go-tgod/tgod/talpa"
 	"github.com/go-tgod/tgod/tieba"
 	"github.com/spf13/viper"
 )
@@ -24,12 +32,256 @@ func loadConfig() {
 func loadDefaultSettingsFor(v *viper.Viper) {
 	v.SetDefault("database", "localhost/tgod")
 	v.SetDefault("maxDownloaderConcurrency", 5)
+	// 运行时通过管理接口可以调整到的最大下载并发, 小于 maxDownloaderConcurrency 时只能减少并发
+	v.SetDefault("downloaderConcurrencyLimit", 0)
+	v.SetDefault("maxDownloaderConcurrencyPerHost", 0)
+	v.SetDefault("downloadDelay", "0s")
+	v.SetDefault("randomizeDownloadDelay", true)
+	v.SetDefault("autoThrottle", false)
+	v.SetDefault("autoThrottleMaxDelay", "60s")
+	v.SetDefault("autoThrottleTargetConcurrency", 1.0)
+	// 按接口的令牌桶限速, 每项为 {endpoint, rate, burst}, endpoint 为 tieba/thread_list,
+	// tieba/post_list 等接口类别或者 "主机/路径", rate 为每秒的请求数, burst 为允许突发的请求数
+	v.SetDefault("rateLimits", []map[string]interface{}{})
+	v.SetDefault("maxRetryTimes", 2)
+	v.SetDefault("retryBackoff", "1s")
+	v.SetDefault("retryMaxBackoff", "1m")
+	v.SetDefault("retryPriorityAdjust", -1)
+	// 需要重试的贴吧错误码, 比如请求过于频繁等临时性错误
+	v.SetDefault("retryErrorCodes", []int{})
 	v.SetDefault("maxScraperConcurrency", 20)
+	// 数据按集合批量写入数据库, 每批的最大数量和未满时的最长等待时间
+	v.SetDefault("storageBatchSize", 100)
+	v.SetDefault("storageFlushInterval", "1s")
+	// 请求队列和任务队列的容量, 0 表示不限制, 队列满时回调等待队列有空间
+	v.SetDefault("maxQueuedRequests", 0)
+	v.SetDefault("maxQueuedJobs", 0)
+	// 请求队列满时的处理方式: block 使回调等待, spill 将超出的请求保存到 queueSpillDir 中
+	v.SetDefault("queueOverflow", "block")
+	v.SetDefault("queueSpillDir", path.Join(os.TempDir(), "tgod"))
+	// 最大请求深度, 0 表示不限制, 贴吧的帖子列表深度为 0, 回帖第一页为 1, 后续页为 2
+	v.SetDefault("maxDepth", 0)
+	// 每深一层请求优先级的减少量, 正数时优先抓取较浅的请求
+	v.SetDefault("depthPriority", 0)
+	// 大于 0 时爬虫处理完请求后不退出, 每隔一段时间检查是否需要重新获取贴吧的帖子列表
+	v.SetDefault("keepAlive", "0s")
+	v.SetDefault("forumPollInterval", "5m")
+	// HTTP 缓存目录, 为空时不使用缓存, 可以使用 http.ResponseDumper 保存的目录
+	v.SetDefault("httpCacheDir", "")
+	// 缓存的有效期, 0 表示永不过期
+	v.SetDefault("httpCacheExpiration", "0s")
+	// 不缓存的响应状态码
+	v.SetDefault("httpCacheIgnoreStatus", []int{500, 502, 503, 504, 408, 429})
+	// 只更新缓存, 不读取缓存
+	v.SetDefault("httpCacheRefreshOnly", false)
+	// 代理地址列表, 支持 http 和 socks5 代理, 为空时不使用代理, 修改配置文件后自动重新载入
+	v.SetDefault("proxies", []string{})
+	// 代理的选择策略: roundRobin, leastUsed 或者 sticky(同一个贴吧使用同一个代理)
+	v.SetDefault("proxyStrategy", "roundRobin")
+	v.SetDefault("proxyBanDuration", "5m")
+	// 定期通过被禁用的代理请求这个地址, 成功时提前恢复使用代理, 为空时只在禁用时间结束后恢复
+	v.SetDefault("proxyCheckURL", "")
+	v.SetDefault("proxyCheckInterval", "30s")
+	// 说明代理被贴吧限制的错误码
+	v.SetDefault("proxyBanErrorCodes", []int{})
+	// Prometheus 指标的监听地址, 为空时不启动
+	v.SetDefault("metricsAddr", "")
+	// 管理接口的监听地址, 为空时不启动, 管理接口没有认证, 应当只监听在本地地址上
+	v.SetDefault("adminAddr", "")
 	v.SetDefault("threadPaginate", tieba.MaxThreadNum)
 	v.SetDefault("postPaginate", tieba.MaxPostNum)
+	// 以下配置可以在 spiders.<贴吧名> 中为每个贴吧单独设置, 其他配置同样可以单独设置, downloadDelay 单独设置时作为爬虫自己的请求间隔
+	v.SetDefault("fetchSubPosts", true)
+	// 每个帖子最多抓取的回帖页数, 0 表示不限制
+	v.SetDefault("maxPagesPerThread", 0)
+	// 贴吧所有请求的基础优先级
+	v.SetDefault("priority", 0)
+	// 多个贴吧共用下载器时的权重和最大并发, 需要使用 NewFairRequestScheduler
+	v.SetDefault("spiderWeight", 1)
+	v.SetDefault("spiderConcurrency", 0)
 }
 
 func init() {
 	loadConfig()
 	loadDefaultSettingsFor(viper.GetViper())
 }
+
+// 只由下载器使用的全局配置, 不会合并到爬虫的配置中. 全局的 downloadDelay 已经作为下载器按主机的延迟,
+// 如果再作为每个爬虫的延迟两者会叠加, 爬虫只有在 spiders.<name> 中单独设置时才有自己的延迟
+var downloaderOnlySettings = map[string]bool{
+	"downloaddelay": true,
+}
+
+// 爬虫的配置, 在全局配置的基础上合并 spiders.<name> 中的配置, 没有单独设置的项使用全局配置
+func SpiderSettings(name string) *viper.Viper {
+	v := viper.New()
+	for _, key := range viper.AllKeys() {
+		if !downloaderOnlySettings[key] {
+			v.SetDefault(key, viper.Get(key))
+		}
+	}
+	if sub := viper.Sub("spiders." + name); sub != nil {
+		for _, key := range sub.AllKeys() {
+			v.Set(key, sub.Get(key))
+		}
+	}
+	return v
+}
+
+// 根据配置生成下载器
+func DownloaderFromConfig() talpa.Downloader {
+	return talpa.NewDownloaderWithOptions(talpa.DownloaderOptions{
+		Concurrency:                   viper.GetInt("maxDownloaderConcurrency"),
+		MaxConcurrency:                viper.GetInt("downloaderConcurrencyLimit"),
+		ConcurrencyPerHost:            viper.GetInt("maxDownloaderConcurrencyPerHost"),
+		Delay:                         viper.GetDuration("downloadDelay"),
+		RandomizeDelay:                viper.GetBool("randomizeDownloadDelay"),
+		AutoThrottle:                  viper.GetBool("autoThrottle"),
+		AutoThrottleMaxDelay:          viper.GetDuration("autoThrottleMaxDelay"),
+		AutoThrottleTargetConcurrency: viper.GetFloat64("autoThrottleTargetConcurrency"),
+		RateLimits:                    rateLimitsFromConfig(),
+	})
+}
+
+// 读取按接口的限速配置, 使用列表是因为接口中的 "." 和大小写在 viper 的键中会被改变
+func rateLimitsFromConfig() map[string]talpa.RateLimit {
+	var entries []struct {
+		Endpoint string
+		Rate     float64
+		Burst    int
+	}
+	if err := viper.UnmarshalKey("rateLimits", &entries); err != nil {
+		Logger.Fatalln("限速配置错误: ", err)
+	}
+	limits := make(map[string]talpa.RateLimit, len(entries))
+	for _, e := range entries {
+		limits[e.Endpoint] = talpa.RateLimit{Rate: e.Rate, Burst: e.Burst}
+	}
+	return limits
+}
+
+// 根据配置生成重试中间件
+func RetryMiddlewareFromConfig() talpa.DownloaderMiddleware {
+	return talpa.NewRetryMiddleware(talpa.RetryPolicy{
+		MaxRetries:     viper.GetInt("maxRetryTimes"),
+		Backoff:        viper.GetDuration("retryBackoff"),
+		MaxBackoff:     viper.GetDuration("retryMaxBackoff"),
+		PriorityAdjust: viper.GetInt("retryPriorityAdjust"),
+		RetryResponse:  TiebaRetryResponse(viper.GetIntSlice("retryErrorCodes")...),
+	})
+}
+
+// 根据配置生成 HTTP 缓存中间件, 没有配置缓存目录时返回 nil
+func HTTPCacheMiddlewareFromConfig() talpa.DownloaderMiddleware {
+	dir := viper.GetString("httpCacheDir")
+	if dir == "" {
+		return nil
+	}
+	return talpa.NewHTTPCacheMiddleware(talpa.HTTPCachePolicy{
+		Dir:          dir,
+		Expiration:   viper.GetDuration("httpCacheExpiration"),
+		IgnoreStatus: viper.GetIntSlice("httpCacheIgnoreStatus"),
+		RefreshOnly:  viper.GetBool("httpCacheRefreshOnly"),
+		Cacheable:    TiebaCacheableResponse,
+	})
+}
+
+var proxyStrategies = map[string]talpa.ProxyStrategy{
+	"roundrobin": talpa.ProxyRoundRobin,
+	"leastused":  talpa.ProxyLeastUsed,
+	"sticky":     talpa.ProxySticky,
+}
+
+// 根据配置生成代理池, 使用配置文件时配置文件修改后重新载入代理列表
+func ProxyPoolFromConfig() talpa.ProxyPool {
+	strategy, ok := proxyStrategies[strings.ToLower(viper.GetString("proxyStrategy"))]
+	if !ok {
+		Logger.Fatalln("未知的代理选择策略: ", viper.GetString("proxyStrategy"))
+	}
+	pool, err := talpa.NewProxyPool(viper.GetStringSlice("proxies"), talpa.ProxyPoolOptions{
+		Strategy:      strategy,
+		BanDuration:   viper.GetDuration("proxyBanDuration"),
+		CheckURL:      viper.GetString("proxyCheckURL"),
+		CheckInterval: viper.GetDuration("proxyCheckInterval"),
+		BanResponse:   TiebaBanResponse(viper.GetIntSlice("proxyBanErrorCodes")...),
+	})
+	if err != nil {
+		Logger.Fatalln(err)
+	}
+	if viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(fsnotify.Event) {
+			if err := ReloadProxiesFromConfig(pool); err != nil {
+				Logger.WithField("Error", err).Errorln("重新载入代理失败")
+			}
+		})
+		viper.WatchConfig()
+	}
+	return pool
+}
+
+// 从配置中重新载入代理列表
+func ReloadProxiesFromConfig(pool talpa.ProxyPool) error {
+	return pool.Reload(viper.GetStringSlice("proxies"))
+}
+
+// 根据配置限制请求调度器在内存中的请求数量, queueOverflow 为 spill 时返回保存超出请求的调度器, 否则返回 rs.
+// rs 不能是去重调度器, 去重调度器需要包装在返回的调度器外层
+func SpillRequestSchedulerFromConfig(rs talpa.RequestScheduler, spiders []talpa.Spider) talpa.RequestScheduler {
+	capacity := viper.GetInt64("maxQueuedRequests")
+	if capacity <= 0 || queueOverflow() != "spill" {
+		return rs
+	}
+	rs, err := talpa.NewSpillRequestScheduler(rs, capacity, viper.GetString("queueSpillDir"), tieba.DefaultRequest, spiders...)
+	if err != nil {
+		Logger.Fatalln(err)
+	}
+	return rs
+}
+
+// 根据配置设置回调入队时的队列容量, 超出的请求保存到磁盘时请求队列不需要等待
+func SetQueueLimitsFromConfig(crawler *talpa.Crawler) {
+	maxRequests := viper.GetInt64("maxQueuedRequests")
+	if queueOverflow() == "spill" {
+		maxRequests = 0
+	}
+	crawler.SetQueueLimits(maxRequests, viper.GetInt64("maxQueuedJobs"))
+}
+
+func queueOverflow() string {
+	policy := strings.ToLower(viper.GetString("queueOverflow"))
+	if policy != "block" && policy != "spill" {
+		Logger.Fatalln("未知的队列溢出策略: ", viper.GetString("queueOverflow"))
+	}
+	return policy
+}
+
+// 根据配置生成深度限制中间件
+func DepthMiddlewareFromConfig() talpa.SpiderMiddleware {
+	return talpa.NewDepthMiddleware(viper.GetInt("maxDepth"), viper.GetInt("depthPriority"))
+}
+
+// 根据配置启动指标监听, 没有配置监听地址时返回 nil
+func ServeMetricsFromConfig(crawler *talpa.Crawler) *http.Server {
+	addr := viper.GetString("metricsAddr")
+	if addr == "" {
+		return nil
+	}
+	srv, err := crawler.ServeMetrics(addr)
+	if err != nil {
+		Logger.Fatalln(err)
+	}
+	return srv
+}
+
+// 根据配置启动管理接口, 没有配置监听地址时返回 nil
+func ServeAdminFromConfig(crawler *talpa.Crawler) *http.Server {
+	addr := viper.GetString("adminAddr")
+	if addr == "" {
+		return nil
+	}
+	srv, err := crawler.ServeAdmin(addr)
+	if err != nil {
+		Logger.Fatalln(err)
+	}
+	return srv
+}
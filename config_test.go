@@ -0,0 +1,31 @@
+package tgod
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestSpiderSettings(t *testing.T) {
+	viper.Set("spiders", map[string]interface{}{
+		"hot": map[string]interface{}{"threadPaginate": 10, "downloadDelay": "2s"},
+	})
+	defer viper.Set("spiders", map[string]interface{}{})
+
+	hot := NewTiebaSpider("hot")
+	if hot.tlrn != 10 || hot.DownloadDelay() != 2*time.Second {
+		t.Errorf("Settings of hot were not merged, tlrn=%d delay=%v", hot.tlrn, hot.DownloadDelay())
+	}
+	// 没有单独设置的项使用全局配置
+	if hot.plrn != viper.GetInt("postPaginate") || !hot.withSubPost {
+		t.Errorf("Global settings were not inherited, plrn=%d withSubPost=%v", hot.plrn, hot.withSubPost)
+	}
+	// 全局的 downloadDelay 只用于下载器, 不会叠加到没有单独设置的爬虫上
+	viper.Set("downloadDelay", "1s")
+	defer viper.Set("downloadDelay", "0s")
+	quiet := NewTiebaSpider("quiet")
+	if quiet.tlrn != viper.GetInt("threadPaginate") || quiet.DownloadDelay() != 0 {
+		t.Errorf("Settings of hot were applied to quiet, tlrn=%d delay=%v", quiet.tlrn, quiet.DownloadDelay())
+	}
+}
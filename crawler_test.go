@@ -45,13 +45,32 @@ func TestCrawler(t *testing.T) {
 	EnsureIndex()
 	time.Sleep(time.Second)
 
-	rs := talpa.NewRequestScheduler(10)
+	spiders := []talpa.Spider{NewTiebaSpider("程集中学")}
+	// 帖子可能同时出现在相邻的两页帖子列表中, 过滤掉重复的请求
+	rs := talpa.NewDupeFilterScheduler(SpillRequestSchedulerFromConfig(talpa.NewFairRequestScheduler(10), spiders), talpa.NewMemoryDupeFilter())
 	is := talpa.NewJobScheduler(10)
-	d := talpa.NewDownloader(viper.GetInt("maxDownloaderConcurrency"))
+	d := DownloaderFromConfig()
 	s := talpa.NewScraper(viper.GetInt("maxScraperConcurrency"))
 
-	spiders := []talpa.Spider{NewTiebaSpider("程集中学")}
 	crawler := talpa.NewCrawler(spiders, rs, d, is, s)
+	SetQueueLimitsFromConfig(crawler)
+	// 缓存需要在重试之前, 命中缓存的请求不需要重试
+	if m := HTTPCacheMiddlewareFromConfig(); m != nil {
+		crawler.UseDownloaderMiddleware(m)
+	}
+	crawler.UseDownloaderMiddleware(RetryMiddlewareFromConfig())
+	// 代理池需要在重试之后, 重试的请求会重新选择代理
+	crawler.UseDownloaderMiddleware(ProxyPoolFromConfig())
+	crawler.UseSpiderMiddleware(DepthMiddlewareFromConfig())
+	crawler.UsePipeline(StoragePipelineFromConfig())
+	crawler.SetKeepAlive(viper.GetDuration("keepAlive"))
+	defer crawler.TogglePauseOn(PauseSignals...)()
+	if srv := ServeMetricsFromConfig(crawler); srv != nil {
+		defer srv.Close()
+	}
+	if srv := ServeAdminFromConfig(crawler); srv != nil {
+		defer srv.Close()
+	}
 	crawler.Start()
 	crawler.Wait()
 }
@@ -1,9 +1,12 @@
 package http
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 
@@ -13,6 +16,14 @@ import (
 
 const DefaultDumpDir = "dump"
 
+// 每个请求的指纹目录下保存的文件
+const (
+	RequestHeaderFile  = "request_header"
+	RequestBodyFile    = "request_body"
+	ResponseHeaderFile = "response_header"
+	ResponseBodyFile   = "response_body"
+)
+
 func Fingerprint(withHeader bool) genp.Plugin {
 	return genp.NewPhasePlugin("before dial", func(ctx *genc.Context, h genc.Handler) {
 		fp, err := RequestFingerprint(ctx.Request, withHeader)
@@ -25,6 +36,82 @@ func Fingerprint(withHeader bool) genp.Plugin {
 	})
 }
 
+// 请求指纹对应的保存目录, dir 为空时使用 DefaultDumpDir
+func DumpDir(dir, fingerprint string) string {
+	if dir == "" {
+		dir = DefaultDumpDir
+	}
+	return path.Join(dir, fingerprint)
+}
+
+func writeDump(dir, fingerprint string, header, body []byte, headerFile, bodyFile string, withBody bool) error {
+	realDir := DumpDir(dir, fingerprint)
+	if err := os.MkdirAll(realDir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(realDir, headerFile), header, os.ModePerm); err != nil {
+		return err
+	}
+	if withBody {
+		return ioutil.WriteFile(path.Join(realDir, bodyFile), body, os.ModePerm)
+	}
+	return nil
+}
+
+// 将请求保存到指纹目录下, body 为 false 时不保存请求体
+func SaveRequest(dir, fingerprint string, req *http.Request, body bool) error {
+	dumpHeader, dumpBody, err := DumpRequest(req, body)
+	if err != nil {
+		return err
+	}
+	return writeDump(dir, fingerprint, dumpHeader, dumpBody, RequestHeaderFile, RequestBodyFile, body)
+}
+
+// 将响应保存到指纹目录下, body 为 false 时不保存响应体. 响应体被读取后会替换为相同内容的副本
+func SaveResponse(dir, fingerprint string, res *http.Response, body bool) error {
+	dumpHeader, dumpBody, err := DumpResponse(res, body)
+	if err != nil {
+		return err
+	}
+	return writeDump(dir, fingerprint, dumpHeader, dumpBody, ResponseHeaderFile, ResponseBodyFile, body)
+}
+
+// 保存响应头和已经读取的响应体, 用于响应体已经被其他地方读取的情况
+func SaveResponseBytes(dir, fingerprint string, res *http.Response, body []byte) error {
+	dumpHeader, _, err := DumpResponse(res, false)
+	if err != nil {
+		return err
+	}
+	return writeDump(dir, fingerprint, dumpHeader, body, ResponseHeaderFile, ResponseBodyFile, true)
+}
+
+// 读取 SaveResponse 或者 ResponseDumper 保存的响应, req 为响应对应的请求.
+// 没有保存过响应时返回的错误满足 os.IsNotExist, 没有保存响应体时响应体为空
+func LoadResponse(dir, fingerprint string, req *http.Request) (*http.Response, error) {
+	realDir := DumpDir(dir, fingerprint)
+	header, err := ioutil.ReadFile(path.Join(realDir, ResponseHeaderFile))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadFile(path.Join(realDir, ResponseBodyFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// 保存时去掉了头部最后的空行
+	header = append(header, "\r\n"...)
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), req)
+	if err != nil {
+		return nil, err
+	}
+	// 保存的是解码后的响应体, 不再使用原来的传输编码和长度
+	res.TransferEncoding = nil
+	res.Header.Del("Transfer-Encoding")
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", fmt.Sprint(len(body)))
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
 func RequestDumper(dir string, body bool) genp.Plugin {
 	return genp.NewPhasePlugin("before dial", func(ctx *genc.Context, h genc.Handler) {
 		fingerprint, ok := ctx.GetOk("FingerPrint")
@@ -32,32 +119,10 @@ func RequestDumper(dir string, body bool) genp.Plugin {
 			h.Error(ctx, errors.New("RequestDumper: Can not get \"FingerPrint\" from context"))
 			return
 		}
-		realDir := dir
-		if realDir == "" {
-			realDir = DefaultDumpDir
-		}
-		realDir = path.Join(realDir, fingerprint.(string))
-		if err := os.MkdirAll(realDir, os.ModePerm); err != nil {
-			h.Error(ctx, fmt.Errorf("RequestDumper: %s", err))
-			return
-		}
-		dumpHeader, dumpBody, err := DumpRequest(ctx.Request, body)
-		if err != nil {
+		if err := SaveRequest(dir, fingerprint.(string), ctx.Request, body); err != nil {
 			h.Error(ctx, fmt.Errorf("RequestDumper: %s", err))
 			return
 		}
-		err = ioutil.WriteFile(path.Join(realDir, "request_header"), dumpHeader, os.ModePerm)
-		if err != nil {
-			h.Error(ctx, fmt.Errorf("RequestDumper: %s", err))
-			return
-		}
-		if body {
-			err = ioutil.WriteFile(path.Join(realDir, "request_body"), dumpBody, os.ModePerm)
-			if err != nil {
-				h.Error(ctx, fmt.Errorf("RequestDumper: %s", err))
-				return
-			}
-		}
 		h.Next(ctx)
 	})
 }
@@ -69,32 +134,10 @@ func ResponseDumper(dir string, body bool) genp.Plugin {
 			h.Error(ctx, errors.New("ResponseDumper: Can not get \"FingerPrint\" from context"))
 			return
 		}
-		realDir := dir
-		if realDir == "" {
-			realDir = DefaultDumpDir
-		}
-		realDir = path.Join(realDir, fingerprint.(string))
-		if err := os.MkdirAll(realDir, os.ModePerm); err != nil {
+		if err := SaveResponse(dir, fingerprint.(string), ctx.Response, body); err != nil {
 			h.Error(ctx, fmt.Errorf("ResponseDumper: %s", err))
 			return
 		}
-		dumpHeader, dumpBody, err := DumpResponse(ctx.Response, body)
-		if err != nil {
-			h.Error(ctx, fmt.Errorf("ResponseDumper: %s", err))
-			return
-		}
-		err = ioutil.WriteFile(path.Join(realDir, "response_header"), dumpHeader, os.ModePerm)
-		if err != nil {
-			h.Error(ctx, fmt.Errorf("ResponseDumper: %s", err))
-			return
-		}
-		if body {
-			err = ioutil.WriteFile(path.Join(realDir, "response_body"), dumpBody, os.ModePerm)
-			if err != nil {
-				h.Error(ctx, fmt.Errorf("ResponseDumper: %s", err))
-				return
-			}
-		}
 		h.Next(ctx)
 	})
 }
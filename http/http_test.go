@@ -0,0 +1,54 @@
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSaveAndLoadResponse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	req := mustReadRequest("GET http://foo.com/ HTTP/1.1\r\n\r\n")
+	if _, err := LoadResponse(dir, "fp", req); !os.IsNotExist(err) {
+		t.Fatalf("LoadResponse returns %v, not exist error expected", err)
+	}
+	res := &http.Response{
+		Status:           "404 Not Found",
+		StatusCode:       404,
+		Proto:            "HTTP/1.1",
+		ProtoMajor:       1,
+		ProtoMinor:       1,
+		Header:           http.Header{"Foo": []string{"Bar"}},
+		TransferEncoding: []string{"chunked"},
+		Body:             ioutil.NopCloser(strings.NewReader("foo")),
+	}
+	if err := SaveResponse(dir, "fp", res, true); err != nil {
+		t.Fatal(err)
+	}
+	// 保存后原来的响应体仍然可以读取
+	if b, _ := ioutil.ReadAll(res.Body); string(b) != "foo" {
+		t.Errorf("Body of saved response is %q", b)
+	}
+
+	loaded, err := LoadResponse(dir, "fp", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(loaded.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.StatusCode != 404 || loaded.Header.Get("Foo") != "Bar" || string(b) != "foo" || loaded.ContentLength != 3 {
+		t.Errorf("Unexpected response %+v with body %q", loaded, b)
+	}
+	if loaded.Request != req {
+		t.Error("Request of loaded response was not set")
+	}
+}
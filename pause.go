@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package tgod
+
+import (
+	"os"
+	"syscall"
+)
+
+// 切换爬虫暂停状态的系统信号, 如 kill -USR1 <pid>
+var PauseSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,6 @@
+package tgod
+
+import "os"
+
+// Windows 没有 SIGUSR1, 不能通过系统信号暂停爬虫
+var PauseSignals []os.Signal
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package tgod
+
+import (
+	"syscall"
+	"time"
+)
+
+// 当前进程消耗的用户态和内核态CPU时间
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
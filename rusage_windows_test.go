@@ -0,0 +1,8 @@
+package tgod
+
+import "time"
+
+// Windows 下不统计CPU时间
+func cpuTime() time.Duration {
+	return 0
+}
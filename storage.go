@@ -1,7 +1,12 @@
 package tgod
 
 import (
+	"fmt"
+	"sync"
+	"time"
+
 	"github.com/Sirupsen/logrus"
+	"github.com/go-tgod/tgod/talpa"
 	"github.com/go-tgod/tgod/tieba"
 	"github.com/spf13/viper"
 	"gopkg.in/mgo.v2"
@@ -86,6 +91,133 @@ func SubPostUpsert(items ...tieba.SubPost) func() {
 	return UpsertJob(SessionFromConfig().DB("").C("SubPost"), pairs...)
 }
 
+// 数据对应的集合和唯一 ID, 不是贴吧数据时 ok 为 false
+func collectionOf(item talpa.Item) (collection, id string, ok bool) {
+	switch v := item.(type) {
+	case tieba.Forum:
+		return "Forum", v.ID, true
+	case tieba.Thread:
+		return "Thread", v.ID, true
+	case tieba.Post:
+		return "Post", v.ID, true
+	case tieba.SubPost:
+		return "SubPost", v.ID, true
+	case tieba.User:
+		return "User", v.ID, true
+	}
+	return "", "", false
+}
+
+// 将贴吧数据保存到数据库中的数据处理管道, 其他类型的数据会原样交给下一个管道.
+// 数据按集合缓存, 达到 batchSize 条或者每隔 flushInterval 通过 Bulk 批量写入, 关闭时写入剩余的数据
+type StoragePipeline struct {
+	session       *mgo.Session
+	batchSize     int
+	flushInterval time.Duration
+	mu            sync.Mutex
+	// 集合名到待写入的 selector, item 对
+	pending map[string][]interface{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+var _ talpa.ItemPipeline = (*StoragePipeline)(nil)
+
+// batchSize 小于 1 时每条数据单独写入, flushInterval 为 0 时只在缓存满和关闭时写入
+func NewStoragePipeline(batchSize int, flushInterval time.Duration) *StoragePipeline {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &StoragePipeline{
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		pending:       make(map[string][]interface{}),
+	}
+}
+
+func StoragePipelineFromConfig() *StoragePipeline {
+	return NewStoragePipeline(viper.GetInt("storageBatchSize"), viper.GetDuration("storageFlushInterval"))
+}
+
+func (p *StoragePipeline) Open() {
+	p.session = SessionFromConfig()
+	p.done = make(chan struct{})
+	if p.flushInterval <= 0 {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.flushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.flushAll()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+func (p *StoragePipeline) Close() {
+	close(p.done)
+	p.wg.Wait()
+	p.flushAll()
+	p.session.Close()
+}
+
+// 数据先加入缓存, 缓存满时由当前调用写入整批数据, 写入失败的错误只返回给这次调用
+func (p *StoragePipeline) ProcessItem(item talpa.Item) (talpa.Item, error) {
+	collection, id, ok := collectionOf(item)
+	if !ok {
+		return item, nil
+	}
+	p.mu.Lock()
+	pairs := append(p.pending[collection], bson.M{"id": id}, item)
+	if len(pairs) < p.batchSize*2 {
+		p.pending[collection] = pairs
+		pairs = nil
+	} else {
+		delete(p.pending, collection)
+	}
+	p.mu.Unlock()
+	if pairs != nil {
+		if err := p.flush(collection, pairs); err != nil {
+			return item, err
+		}
+	}
+	return item, nil
+}
+
+// 写入所有缓存的数据, 错误只记录日志
+func (p *StoragePipeline) flushAll() {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = make(map[string][]interface{})
+	p.mu.Unlock()
+	for collection, pairs := range pending {
+		if err := p.flush(collection, pairs); err != nil {
+			Logger.WithField("Collection", collection).Errorln(err)
+		}
+	}
+}
+
+// 每批复制一个会话, 与 UpsertJob 一样通过连接池并发写入. 使用无序写入, 一条数据出错不影响其他数据
+func (p *StoragePipeline) flush(collection string, pairs []interface{}) error {
+	session := p.session.Copy()
+	defer session.Close()
+	bulk := session.DB("").C(collection).Bulk()
+	bulk.Unordered()
+	bulk.Upsert(pairs...)
+	result, err := bulk.Run()
+	if err != nil {
+		return fmt.Errorf("upsert %d items into %s: %s", len(pairs)/2, collection, err)
+	}
+	Logger.WithFields(logrus.Fields{"Collection": collection, "NumItem": len(pairs) / 2, "Matched": result.Matched, "Modified": result.Modified}).Debugln("Items were stored")
+	return nil
+}
+
 // 初始化数据库索引
 func EnsureIndex() {
 	session := SessionFromConfig()
@@ -0,0 +1,190 @@
+package talpa
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Crawler 的整体运行状态
+type CrawlerStatus struct {
+	Paused bool `json:"paused"`
+	Closed bool `json:"closed"`
+	// 队列中和已经分发但还没有处理完成的请求数量
+	QueuedRequests   int64 `json:"queued_requests"`
+	InflightRequests int64 `json:"inflight_requests"`
+	QueuedJobs       int64 `json:"queued_jobs"`
+	InflightJobs     int64 `json:"inflight_jobs"`
+	// 下载器当前的并发数
+	Concurrency int           `json:"concurrency"`
+	Stats       StatsSnapshot `json:"stats"`
+}
+
+// 当前的运行状态, 可以在运行过程中调用
+func (c *Crawler) Status() CrawlerStatus {
+	status := CrawlerStatus{
+		Paused:           c.Paused(),
+		Closed:           c.Closed(),
+		QueuedRequests:   c.requestScheduler.Len(),
+		InflightRequests: c.numInflightRequests(),
+		InflightJobs:     atomic.LoadInt64(&c.inflightJobs),
+		Concurrency:      c.downloader.NumWorkers(),
+		Stats:            c.Stats(),
+	}
+	if c.jobScheduler != nil {
+		status.QueuedJobs = c.jobScheduler.Len()
+	}
+	return status
+}
+
+// 按爬虫, 回调和优先级汇总队列中的请求, 请求调度器没有实现 SummarizedScheduler 时返回 false
+func (c *Crawler) QueueSummary() ([]QueueSummary, bool) {
+	ss, ok := summarizedSchedulerOf(c.requestScheduler)
+	if !ok {
+		return nil, false
+	}
+	return ss.Summary(), true
+}
+
+// 根据名称找到爬虫
+func (c *Crawler) spiderByName(name string) (Spider, bool) {
+	for _, s := range c.spiders {
+		if SpiderName(s) == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// 管理接口的错误响应
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func (c *Crawler) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		c.logger.WithField("Error", err).Warnln("Failed to write admin response")
+	}
+}
+
+// 只允许指定方法的请求, 其他方法返回 405
+func (c *Crawler) adminRoute(method string, h func(w http.ResponseWriter, r *http.Request)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			c.writeJSON(w, http.StatusMethodNotAllowed, adminError{fmt.Sprintf("method %s is not allowed", r.Method)})
+			return
+		}
+		h(w, r)
+	})
+}
+
+// 用于运行时查看和控制 Crawler 的 http.Handler, 响应都是 JSON:
+//
+//	GET  /status                         整体运行状态
+//	GET  /spiders                        每个爬虫的状态
+//	GET  /queue                          按爬虫, 回调和优先级汇总的队列内容
+//	POST /requests?spider=&kind=&...     通过 AdhocSpider 为爬虫添加请求, 其他参数交给爬虫构造请求
+//	POST /concurrency?n=                 调整下载器的并发数
+//	POST /pause, /resume, /stop          暂停, 恢复和停止 Crawler
+//
+// 操作成功时返回操作后的整体运行状态
+func (c *Crawler) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	status := func(w http.ResponseWriter, r *http.Request) {
+		c.writeJSON(w, http.StatusOK, c.Status())
+	}
+	mux.Handle("/status", c.adminRoute("GET", status))
+	mux.Handle("/spiders", c.adminRoute("GET", func(w http.ResponseWriter, r *http.Request) {
+		c.writeJSON(w, http.StatusOK, c.SpiderStatus())
+	}))
+	mux.Handle("/queue", c.adminRoute("GET", func(w http.ResponseWriter, r *http.Request) {
+		summary, ok := c.QueueSummary()
+		if !ok {
+			c.writeJSON(w, http.StatusNotImplemented, adminError{"request scheduler can not be summarized"})
+			return
+		}
+		c.writeJSON(w, http.StatusOK, summary)
+	}))
+	mux.Handle("/requests", c.adminRoute("POST", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			c.writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		name := r.Form.Get("spider")
+		s, ok := c.spiderByName(name)
+		if !ok {
+			c.writeJSON(w, http.StatusNotFound, adminError{fmt.Sprintf("spider %q not found", name)})
+			return
+		}
+		as, ok := s.(AdhocSpider)
+		if !ok {
+			c.writeJSON(w, http.StatusNotImplemented, adminError{fmt.Sprintf("spider %q does not accept adhoc requests", name)})
+			return
+		}
+		req, err := as.AdhocRequest(r.Form.Get("kind"), r.Form)
+		if err != nil {
+			c.writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		if err := c.PutRequest(s, req); err != nil {
+			code := http.StatusBadRequest
+			if err == ErrCrawlerClosed {
+				code = http.StatusConflict
+			}
+			c.writeJSON(w, code, adminError{err.Error()})
+			return
+		}
+		c.logger.WithFields(logrus.Fields{"Spider": name, "Kind": r.Form.Get("kind")}).Infoln("Adhoc request was scheduled")
+		status(w, r)
+	}))
+	mux.Handle("/concurrency", c.adminRoute("POST", func(w http.ResponseWriter, r *http.Request) {
+		n, err := strconv.Atoi(r.FormValue("n"))
+		if err == nil {
+			err = c.SetDownloaderConcurrency(n)
+		}
+		if err != nil {
+			c.writeJSON(w, http.StatusBadRequest, adminError{err.Error()})
+			return
+		}
+		status(w, r)
+	}))
+	mux.Handle("/pause", c.adminRoute("POST", func(w http.ResponseWriter, r *http.Request) {
+		c.Pause()
+		status(w, r)
+	}))
+	mux.Handle("/resume", c.adminRoute("POST", func(w http.ResponseWriter, r *http.Request) {
+		c.Resume()
+		status(w, r)
+	}))
+	mux.Handle("/stop", c.adminRoute("POST", func(w http.ResponseWriter, r *http.Request) {
+		// Stop 会等待所有工作结束, 不能阻塞响应
+		go c.Stop()
+		c.writeJSON(w, http.StatusAccepted, c.Status())
+	}))
+	return mux
+}
+
+// 在 addr 上启动管理接口, 返回的 http.Server 由调用者关闭.
+// 管理接口没有认证, 应当只监听在本地或者内网地址上
+func (c *Crawler) ServeAdmin(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: c.AdminHandler()}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			c.logger.WithField("Error", err).Errorln("Admin server stopped")
+		}
+	}()
+	c.logger.WithField("Addr", srv.Addr).Infoln("Admin server started")
+	return srv, nil
+}
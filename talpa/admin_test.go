@@ -0,0 +1,137 @@
+package talpa
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 可以通过管理接口添加请求的爬虫, kind 为 page 时请求 url 加上参数 n
+type adhocSpider struct {
+	testSpider
+}
+
+func (s *adhocSpider) Name() string {
+	return "adhoc"
+}
+func (s *adhocSpider) AdhocRequest(kind string, params url.Values) (*gen.Request, error) {
+	if kind != "page" {
+		return nil, errors.New("unknown kind")
+	}
+	req := gen.NewRequest().URL(s.url + "?n=" + params.Get("n"))
+	MetaOf(req).CallBack = s.Parse
+	MetaOf(req).Priority = 1
+	return req, nil
+}
+
+// 向管理接口发送请求并解析 JSON 响应, 返回状态码
+func adminDo(t *testing.T, h http.Handler, method, target string, v interface{}) int {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s returns %q: %v", method, target, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+func TestCrawlerAdmin(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	spider := &adhocSpider{testSpider{url: ts.URL, num: 1}}
+	d := NewDownloaderWithOptions(DownloaderOptions{Concurrency: 2, MaxConcurrency: 4})
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), d, NewJobScheduler(10), NewScraper(2))
+	crawler.SetKeepAlive(time.Hour)
+	h := crawler.AdminHandler()
+	// 启动前暂停, 初始请求也留在队列中
+	var status CrawlerStatus
+	if code := adminDo(t, h, "POST", "/pause", &status); code != http.StatusOK || !status.Paused {
+		t.Errorf("Pause returns %d %+v", code, status)
+	}
+	crawler.Start()
+	for i := 0; i < 3; i++ {
+		if code := adminDo(t, h, "POST", "/requests?spider=adhoc&kind=page&n="+strconv.Itoa(i), nil); code != http.StatusOK {
+			t.Errorf("Adhoc request returns %d", code)
+		}
+	}
+	var summary []QueueSummary
+	adminDo(t, h, "GET", "/queue", &summary)
+	expected := []QueueSummary{
+		{Spider: "adhoc", CallBack: "Parse", Priority: 1, Count: 3},
+		{Spider: "adhoc", CallBack: "Parse", Priority: 0, Count: 1},
+	}
+	if len(summary) != 2 || summary[0] != expected[0] || summary[1] != expected[1] {
+		t.Errorf("Queue summary is %+v, %+v expected", summary, expected)
+	}
+
+	var e adminError
+	if code := adminDo(t, h, "POST", "/requests?spider=adhoc&kind=thread", &e); code != http.StatusBadRequest || e.Error == "" {
+		t.Errorf("Invalid adhoc request returns %d %+v", code, e)
+	}
+	if code := adminDo(t, h, "POST", "/requests?spider=other", nil); code != http.StatusNotFound {
+		t.Errorf("Request for unknown spider returns %d, 404 expected", code)
+	}
+	if code := adminDo(t, h, "POST", "/concurrency?n=5", nil); code != http.StatusBadRequest {
+		t.Errorf("Concurrency beyond the limit returns %d, 400 expected", code)
+	}
+	if adminDo(t, h, "POST", "/concurrency?n=4", &status); status.Concurrency != 4 {
+		t.Errorf("Concurrency is %d, 4 expected", status.Concurrency)
+	}
+	if code := adminDo(t, h, "GET", "/pause", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /pause returns %d, 405 expected", code)
+	}
+
+	adminDo(t, h, "POST", "/resume", &status)
+	deadline := time.Now().Add(time.Second)
+	for status.Stats.Counters[StatsJobFinished] < 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		adminDo(t, h, "GET", "/status", &status)
+	}
+	if status.Paused || status.QueuedRequests != 0 || status.Stats.Counters[StatsJobFinished] != 4 {
+		t.Errorf("Requests were not finished after resume: %+v", status)
+	}
+	var spiders []SpiderStatus
+	if adminDo(t, h, "GET", "/spiders", &spiders); len(spiders) != 1 || spiders[0].Sent != 4 {
+		t.Errorf("Spider status is %+v, 4 requests sent expected", spiders)
+	}
+
+	if code := adminDo(t, h, "POST", "/stop", nil); code != http.StatusAccepted {
+		t.Errorf("Stop returns %d, 202 expected", code)
+	}
+	crawler.Wait()
+	if code := adminDo(t, h, "POST", "/requests?spider=adhoc&kind=page", nil); code != http.StatusConflict {
+		t.Errorf("Adhoc request after stop returns %d, 409 expected", code)
+	}
+}
+
+// 同时入队和出队时汇总的计数不会残留
+func TestQueueSummaryConcurrent(t *testing.T) {
+	const num = 1000
+	rs := NewRequestScheduler(0).(*requestScheduler)
+	spider := &testSpider{num: 1}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for got := 0; got < num; {
+			got += len(rs.Get(1))
+		}
+	}()
+	for i := 0; i < num; i++ {
+		req := gen.NewRequest()
+		MetaOf(req).CallBack = spider.Parse
+		rs.Put(req)
+	}
+	<-done
+	if summary := rs.Summary(); len(summary) != 0 {
+		t.Errorf("Summary of an empty queue is %v", summary)
+	}
+}
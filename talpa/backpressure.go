@@ -0,0 +1,115 @@
+package talpa
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 队列的容量限制, 队列达到上限时回调中的入队操作等待队列有空间
+type queueBound struct {
+	limit  int64
+	length func() int64
+	// 开始等待时调用, 用于唤醒分发循环
+	onWait func()
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	waiting  int64
+	released bool
+}
+
+// limit 不大于 0 时不限制, 返回 nil
+func newQueueBound(limit int64, length func() int64, onWait func()) *queueBound {
+	if limit <= 0 {
+		return nil
+	}
+	b := &queueBound{limit: limit, length: length, onWait: onWait}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// 队列为空时总是可以放入, 避免一次放入的数量超过上限时永远等待
+func (b *queueBound) full(n int) bool {
+	l := b.length()
+	return l > 0 && l+int64(n) > b.limit
+}
+
+// 等待直到队列可以放入 n 个元素或者限制被解除, 然后调用 put 入队, 返回等待的时间.
+// waiting 不为 nil 时在等待期间加 1, 用于记录每个爬虫正在等待的回调数量.
+// put 在持有锁时调用, 避免同时等待的多个回调一起入队超过上限
+func (b *queueBound) put(n int, waiting *int64, put func()) time.Duration {
+	if b == nil {
+		put()
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var start time.Time
+	for !b.released && b.full(n) {
+		if start.IsZero() {
+			start = time.Now()
+			if waiting != nil {
+				atomic.AddInt64(waiting, 1)
+			}
+			atomic.AddInt64(&b.waiting, 1)
+			if b.onWait != nil {
+				b.onWait()
+			}
+		}
+		b.cond.Wait()
+	}
+	var wait time.Duration
+	if !start.IsZero() {
+		atomic.AddInt64(&b.waiting, -1)
+		if waiting != nil {
+			atomic.AddInt64(waiting, -1)
+		}
+		wait = time.Since(start)
+	}
+	put()
+	return wait
+}
+
+// 队列中的元素被取出后唤醒等待者
+func (b *queueBound) signal() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// 解除限制, Crawler 退出时调用, 之后入队不再等待
+func (b *queueBound) release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.released = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// 正在等待的入队操作数量
+func (b *queueBound) numWaiting() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.waiting)
+}
+
+// 设置请求队列和任务队列的容量, 不大于 0 时不限制, 需要在爬虫启动前调用.
+// 队列达到上限后回调中的 Helper.PutRequest 和 PutJob 会等待队列有空间, 使回调产生请求和数据的速度与处理速度一致.
+// 等待请求队列的回调不占用下载器的并发和爬虫的并发配额, 以便分发循环继续取出请求; 等待任务队列的回调仍然占用并发, 从而减慢下载.
+// 初始请求, Idle 和 Crawler.PutRequest 添加的请求不受限制, Crawler 正在退出时也不再等待.
+// 需要在磁盘中保存超出容量的请求而不是等待时使用 NewSpillRequestScheduler
+func (c *Crawler) SetQueueLimits(maxRequests, maxJobs int64) {
+	// 下载器中等待限速的请求已经从队列中取出但还没有发送, 同样计入队列的长度
+	length := func() int64 { return c.requestScheduler.Len() + c.numThrottled() }
+	c.requestBound = newQueueBound(maxRequests, length, func() { notify(c.requestSignal) })
+	if c.jobScheduler != nil {
+		c.jobBound = newQueueBound(maxJobs, c.jobScheduler.Len, nil)
+	}
+}
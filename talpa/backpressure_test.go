@@ -0,0 +1,120 @@
+package talpa
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 每个响应产生 fanout 个下一层的请求, 直到达到 levels 层
+type fanoutSpider struct {
+	url    string
+	fanout int
+	levels int
+	parsed int32
+}
+
+func (s *fanoutSpider) request() *gen.Request {
+	req := gen.NewRequest().URL(s.url)
+	MetaOf(req).CallBack = s.Parse
+	return req
+}
+func (s *fanoutSpider) StartRequests() []*gen.Request {
+	reqs := make([]*gen.Request, s.fanout)
+	for i := range reqs {
+		reqs[i] = s.request()
+	}
+	return reqs
+}
+func (s *fanoutSpider) Parse(res *gen.Response, h Helper) {
+	atomic.AddInt32(&s.parsed, 1)
+	if ResponseMeta(res).Depth+1 >= s.levels {
+		return
+	}
+	reqs := make([]*gen.Request, s.fanout)
+	for i := range reqs {
+		reqs[i] = s.request()
+	}
+	h.PutRequest(reqs...)
+}
+
+// 有并发配额的 fanoutSpider
+type quotaFanoutSpider struct {
+	fanoutSpider
+	concurrency int
+}
+
+func (s *quotaFanoutSpider) Weight() int {
+	return 1
+}
+func (s *quotaFanoutSpider) Concurrency() int {
+	return s.concurrency
+}
+
+func TestCrawlerQueueLimits(t *testing.T) {
+	ts := newTestServer(time.Millisecond)
+	defer ts.Close()
+
+	t.Run("Request", func(t *testing.T) {
+		// 5 + 25 + 125 个请求, 队列最多 10 个请求, 所有回调都在等待时不能死锁
+		spider := &fanoutSpider{url: ts.URL, fanout: 5, levels: 3}
+		crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(4), nil, nil)
+		crawler.SetQueueLimits(10, 0)
+		if err := crawler.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if spider.parsed != 155 {
+			t.Errorf("%d responses were parsed, 155 expected", spider.parsed)
+		}
+		if max := crawler.Stats().MaxValues[StatsQueueRequest]; max > 10 {
+			t.Errorf("Max queue length is %d, no more than 10 expected", max)
+		}
+	})
+	t.Run("Quota", func(t *testing.T) {
+		// 爬虫所有占用配额的回调都在等待时, 仍然可以分发这个爬虫的请求
+		spider := &quotaFanoutSpider{fanoutSpider{url: ts.URL, fanout: 4, levels: 3}, 2}
+		crawler := NewCrawler([]Spider{spider}, NewFairRequestScheduler(10), NewDownloader(4), nil, nil)
+		crawler.SetQueueLimits(10, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := crawler.Run(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if spider.parsed != 84 {
+			t.Errorf("%d responses were parsed, 84 expected", spider.parsed)
+		}
+	})
+	t.Run("Job", func(t *testing.T) {
+		spider := &testSpider{url: ts.URL, num: 30}
+		crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(4), NewJobScheduler(10), NewScraper(2))
+		crawler.SetQueueLimits(0, 3)
+		if err := crawler.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if spider.scraped != 30 {
+			t.Errorf("%d jobs were finished, 30 expected", spider.scraped)
+		}
+		stats := crawler.Stats()
+		if max := stats.MaxValues[StatsQueueJob]; max > 3 {
+			t.Errorf("Max queue length is %d, no more than 3 expected", max)
+		}
+		if stats.Counters[StatsBackpressureJobWait] == 0 {
+			t.Error("Wait time was not recorded")
+		}
+	})
+	t.Run("Drain", func(t *testing.T) {
+		// 取消后等待中的回调直接入队, Run 能够结束
+		ctx, cancel := context.WithCancel(context.Background())
+		spider := &fanoutSpider{url: ts.URL, fanout: 5, levels: 4}
+		crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(4), nil, nil)
+		crawler.SetQueueLimits(5, 0)
+		time.AfterFunc(20*time.Millisecond, cancel)
+		err := crawler.Run(ctx)
+		if summary, ok := err.(*ErrorSummary); !ok || summary.NumUnscheduled == 0 {
+			t.Errorf("Run returns %v, unscheduled requests expected", err)
+		}
+	})
+}
@@ -1,132 +1,642 @@
 package talpa
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"runtime"
+	"os"
+	"os/signal"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	gen "gopkg.in/h2non/gentleman.v2"
 )
 
+// Crawler 已经结束, 不能再添加请求
+var ErrCrawlerClosed = errors.New("talpa: crawler closed")
+
 // 提供核心的爬虫工作分发机制, 只能运行一次
 type Crawler struct {
 	spiders          []Spider
 	requestScheduler RequestScheduler
-	downloader       Downloader
-	jobScheduler     JobScheduler
-	scraper          Scraper
+	// 请求调度器本身或者被包装的 SpiderScheduler, 为 nil 时不能按爬虫限制并发和检查完成状态
+	spiderScheduler SpiderScheduler
+	spiderStates    map[Spider]*spiderState
+	downloader      Downloader
+	jobScheduler    JobScheduler
+	scraper         Scraper
+
+	spiderMiddlewares spiderMiddlewares
+	pipelines         itemPipelines
+
+	// 请求和任务入队或处理完成时发出信号唤醒对应的分发循环
+	requestSignal chan struct{}
+	jobSignal     chan struct{}
+	// 已经分发但还没有处理完成的请求和任务数量
+	inflightRequests int64
+	inflightJobs     int64
+	// 为 1 时暂停分发请求和任务
+	paused int32
+	// 回调入队时的队列容量限制, 为 nil 时不限制
+	requestBound *queueBound
+	jobBound     *queueBound
 
-	requestLoopClosed bool
-	itemLoopClosed    bool
+	requestLoopClosed chan struct{}
+	itemLoopClosed    chan struct{}
 	wg                sync.WaitGroup
 	stopped           chan bool
+	// 取消时停止分发新的请求, 但会等待已发出的请求和任务处理完成
+	ctx         context.Context
+	errs        errorRecorder
+	unscheduled int64
+	stats       *Stats
+	signals     signalBus
+	closeOnce   sync.Once
+	stopOnce    sync.Once
+	// 没有 ErrBack 的请求错误以及任务中的错误交给这个函数处理, 为空时只记录日志
+	errorHandler func(err error)
+	// 大于 0 时请求处理完也不退出, 每隔 keepAlive 询问一次爬虫是否有新的请求
+	keepAlive time.Duration
+
+	// 请求循环退出后请求队列被销毁, 之后入队的请求(例如延迟重试的请求)直接丢弃并计入 unscheduled
+	disposeMu sync.RWMutex
+	disposed  bool
 
 	logger *logrus.Entry
 }
 
 func (c *Crawler) Closed() bool {
-	return c.requestLoopClosed && c.itemLoopClosed
+	return isClosed(c.requestLoopClosed) && isClosed(c.itemLoopClosed)
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// 非阻塞地发出信号, 信号通道有一个缓冲, 在循环没有等待时发出的信号也不会丢失
+func notify(signal chan struct{}) {
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
 }
 
 func (c *Crawler) loopRequest() {
 	c.wg.Add(1)
+	if td, ok := c.downloader.(ThrottledDownloader); ok {
+		// 等待限速的请求计入请求队列的容量, 数量变化时唤醒分发循环和等待队列空间的回调
+		td.OnThrottled(func() {
+			c.requestBound.signal()
+			notify(c.requestSignal)
+		})
+	}
 	c.downloader.Open()
 	go func() {
 		defer func() {
+			// 退出后不会再取出请求, 等待中的回调需要直接入队才能结束
+			c.requestBound.release()
+			c.jobBound.release()
+			c.disposeMu.Lock()
+			atomic.AddInt64(&c.unscheduled, c.requestScheduler.Len())
 			c.requestScheduler.Dispose()
+			c.disposed = true
+			c.disposeMu.Unlock()
 			c.downloader.Close()
-			c.requestLoopClosed = true
+			close(c.requestLoopClosed)
+			notify(c.jobSignal)
 			c.wg.Done()
 			c.logger.Debugln("Request Loop stopped")
 		}()
-		// 所有请求回调共享一个helper对象, 节约内存
-		h := helper{rs: c.requestScheduler, is: c.jobScheduler}
-		run := true
-		for run {
+		done := c.ctx.Done()
+		draining := false
+		for {
 			select {
 			case <-c.stopped:
-				run = false
+				return
+			case <-done:
+				// 停止分发新的请求, 等待已发出的请求及其回调处理完成
+				c.logger.WithField("Cause", c.ctx.Err()).Infoln("Crawler is draining")
+				draining = true
+				done = nil
+				c.requestBound.release()
+				c.jobBound.release()
 			default:
-				if !c.requestScheduler.Empty() {
-					// 异步发送会导致请求队列一直为空, 并且不断地产生等待的goroutine, 需要限制的等待任务的数量
-					// 将等待任务数量与Worker数量一致确保总有任务在工作
-					if c.downloader.NumWaitingJobs() < c.downloader.NumWorkers() {
-						// 队列不为空直接从队列中获得一个请求
-						req := c.requestScheduler.Get(1)[0]
-						c.downloader.Fetch(req, &h)
-					}
-				} else if c.downloader.NumWaitingJobs() == 0 {
-					// 调度器已为空, 也没有在等待发送的请求, 说明所有请求已处理完
-					run = false
+			}
+			// 必须先读取在途请求数量再检查队列, 回调在完成前就已经将新的请求入队,
+			// 在途请求数量为 0 时队列的状态才是确定的
+			inflight := atomic.LoadInt64(&c.inflightRequests)
+			// 异步发送会不断地产生等待的goroutine, 将在途请求数量与Worker数量一致确保总有任务在工作,
+			// 下载器的并发可能在运行时被调整, 每次都重新读取
+			workers := int64(c.downloader.NumWorkers())
+			paused := c.Paused()
+			// 等待请求队列空间的回调和等待限速的请求不占用并发, 否则所有回调都在等待时没有请求能被取出,
+			// 或者被限速的主机占满并发时其他主机的请求不能发送
+			waiting := c.requestBound.numWaiting() + c.numThrottled()
+			if !draining && !paused && inflight-waiting < workers && !c.requestScheduler.Empty() {
+				// 所有有请求的爬虫都达到并发配额时等待在途请求完成
+				if req := c.nextRequest(); req != nil {
+					c.requestBound.signal()
+					atomic.AddInt64(&c.inflightRequests, 1)
+					c.spiderSent(spiderOf(req))
+					c.stats.Inc(StatsRequestSent, 1)
+					c.fetch(req)
+					continue
+				}
+			}
+			// 暂停时即使没有请求也不退出, 等待恢复或者停止
+			if inflight == 0 && (draining || !paused && c.requestScheduler.Empty()) {
+				// 调度器已为空或正在退出, 也没有在途的请求, 说明所有请求已处理完.
+				// 退出前通知爬虫已经空闲, 爬虫或信号处理函数添加了新的请求时继续运行
+				if !draining && c.idle() {
+					continue
 				}
+				if draining || c.keepAlive <= 0 {
+					return
+				}
+				// 保持运行, 有新的请求入队或者等待一段时间后再次询问爬虫
+				select {
+				case <-c.requestSignal:
+				case <-c.stopped:
+				case <-done:
+				case <-time.After(c.keepAlive):
+				}
+				continue
+			}
+			// 等待新的请求入队, 在途请求完成, 爬虫的请求间隔结束或者从暂停中恢复, 停止和取消在下一次循环开始时处理
+			select {
+			case <-c.requestSignal:
+			case <-c.stopped:
+			case <-done:
+			case <-c.spiderDelayTimer():
 			}
-			c.logger.WithFields(logrus.Fields{"NumRequest": c.requestScheduler.Len(), "NumWaitingJobs": c.downloader.NumWaitingJobs()}).Debugln()
-			// goroutine 是协程, 主动释放CPU避免持续占用
-			runtime.Gosched()
 		}
 	}()
 }
+
+// 从调度器中取出下一个请求, 使用 SpiderScheduler 时跳过达到并发配额的爬虫, 没有可以发送的请求时返回 nil
+func (c *Crawler) nextRequest() *gen.Request {
+	if c.spiderScheduler != nil {
+		return c.spiderScheduler.GetFrom(c.spiderAvailable)
+	}
+	if reqs := c.requestScheduler.Get(1); len(reqs) > 0 {
+		return reqs[0]
+	}
+	return nil
+}
+
+// 下载器中等待限速的请求数量, 下载器没有实现 ThrottledDownloader 时为 0
+func (c *Crawler) numThrottled() int64 {
+	if td, ok := c.downloader.(ThrottledDownloader); ok {
+		return int64(td.NumThrottled())
+	}
+	return 0
+}
+
+func (c *Crawler) numInflightRequests() int64 {
+	return atomic.LoadInt64(&c.inflightRequests)
+}
+
+// 对每个爬虫调用 spiderIdle, 返回是否有新的请求入队
+func (c *Crawler) idle() bool {
+	for _, s := range c.spiders {
+		c.spiderIdle(s)
+	}
+	return !c.requestScheduler.Empty()
+}
+
+// 保持运行时向实现了 IdleSpider 的爬虫获取新的请求, 然后发出 SpiderIdle 信号.
+// 没有保持运行时不调用 Idle, 避免一次性的抓取因为爬虫定期产生的请求而无法退出
+func (c *Crawler) spiderIdle(s Spider) {
+	h := &helper{crawler: c, spider: s}
+	if is, ok := s.(IdleSpider); ok && c.keepAlive > 0 {
+		h.PutRequest(c.spiderMiddlewares.processRequests(nil, is.Idle())...)
+	}
+	c.emit(Event{Signal: SpiderIdle, Spider: s, Helper: h})
+}
+
+// 发送请求并在请求完成后执行回调
+func (c *Crawler) fetch(req *gen.Request) {
+	// helper 记录了请求所属的爬虫, 用于标记回调产生的新请求
+	h := &helper{crawler: c, spider: spiderOf(req), depth: MetaOf(req).Depth + 1, bounded: true}
+	c.downloader.Fetch(req, h, func(res *gen.Response, err error) {
+		// 爬虫的在途请求数量需要在总数之前减少, 总数为 0 时所有爬虫的状态都是确定的
+		defer func() {
+			c.spiderDone(h.spider)
+			atomic.AddInt64(&c.inflightRequests, -1)
+			notify(c.requestSignal)
+		}()
+		c.scrape(req, res, err, h)
+	})
+}
+
+// 记录请求在限速中等待的时间, 总时间和每个接口的时间单位都为毫秒
+func (c *Crawler) recordRateLimit(req *gen.Request) {
+	key, ok := req.Context.GetOk("RateLimit")
+	if !ok {
+		return
+	}
+	wait, _ := req.Context.GetOk("RateLimitWait")
+	// 重新入队的请求再次发送时重新记录
+	req.Context.Delete("RateLimit")
+	req.Context.Delete("RateLimitWait")
+	ms := int64(wait.(time.Duration) / time.Millisecond)
+	c.stats.Inc(StatsRateLimitWait, ms)
+	c.stats.Inc(StatsRateLimitWait+"/"+key.(string), ms)
+}
+
+// 请求出错时执行 ErrBack 并记录错误, 否则经过爬虫中间件执行 CallBack
+func (c *Crawler) scrape(req *gen.Request, res *gen.Response, err error, h *helper) {
+	c.recordRateLimit(req)
+	if res == nil {
+		// 请求被丢弃或者重新入队
+		if err == ErrDropRequest {
+			c.stats.Inc(StatsRequestDropped, 1)
+			c.emit(Event{Signal: RequestDropped, Spider: h.spider, Request: req})
+		}
+		return
+	}
+	if res.StatusCode > 0 {
+		c.stats.Inc("response/status/"+strconv.Itoa(res.StatusCode), 1)
+	}
+	if err != nil {
+		c.errs.Record(err)
+		c.stats.Inc(StatsRequestFailed, 1)
+		c.emit(Event{Signal: RequestFailed, Spider: h.spider, Request: req, Response: res, Err: err})
+		c.errBack(req, res, err)
+		return
+	}
+	// 中间件直接构造的响应可能没有底层的 http.Response, 不能读取内容
+	if res.RawResponse != nil {
+		c.stats.Inc(StatsResponseBytes, int64(len(res.Bytes())))
+	}
+	if latency, ok := res.Context.GetOk("Latency"); ok {
+		c.stats.Latency(latency.(time.Duration))
+	}
+	c.emit(Event{Signal: ResponseReceived, Spider: h.spider, Request: req, Response: res})
+	var cbHelper Helper = h
+	if len(c.spiderMiddlewares) > 0 {
+		cbHelper = &middlewareHelper{Helper: h, res: res, ms: c.spiderMiddlewares}
+	}
+	// 回调中的 panic 没有被爬虫中间件处理时作为错误记录, 并交给 ErrBack 处理, 爬虫继续运行
+	defer func() {
+		if v := recover(); v != nil {
+			perr := newPanicError(v)
+			if c.spiderMiddlewares.processCallbackError(res, perr) {
+				return
+			}
+			c.errs.Record(perr)
+			c.stats.Inc(StatsCallbackError, 1)
+			c.emit(Event{Signal: RequestFailed, Spider: h.spider, Request: req, Response: res, Err: perr})
+			c.errBack(req, res, perr)
+		}
+	}()
+	// 请求入队时已经检查过 CallBack
+	MetaOf(req).CallBack(res, cbHelper)
+}
+
+// 执行请求的 ErrBack, 没有设置 ErrBack 时交给 Crawler 的错误处理函数.
+// ErrBack 中的 panic 同样会被记录并交给错误处理函数
+func (c *Crawler) errBack(req *gen.Request, res *gen.Response, err error) {
+	res.Error = err
+	errBack := MetaOf(req).ErrBack
+	if errBack == nil {
+		c.handleError(err)
+		return
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			perr := newPanicError(v)
+			c.errs.Record(perr)
+			c.stats.Inc(StatsCallbackError, 1)
+			c.handleError(perr)
+		}
+	}()
+	errBack(res)
+}
+
+// 包装任务, 任务中的 panic 会被记录并交给错误处理函数
+func (c *Crawler) safeJob(job func()) func() {
+	return func() {
+		defer func() {
+			if v := recover(); v != nil {
+				perr := newPanicError(v)
+				c.errs.Record(perr)
+				c.stats.Inc(StatsJobError, 1)
+				c.emit(Event{Signal: JobFailed, Err: perr})
+				c.handleError(perr)
+			}
+		}()
+		job()
+	}
+}
+
+func (c *Crawler) handleError(err error) {
+	if c.errorHandler != nil {
+		c.errorHandler(err)
+		return
+	}
+	entry := c.logger.WithField("Error", err)
+	if perr, ok := err.(*PanicError); ok {
+		entry = entry.WithField("Stack", string(perr.Stack))
+	}
+	entry.Errorln("Unhandled error")
+}
+
 func (c *Crawler) loopItem() {
 	c.wg.Add(1)
 	// 格式化数据调度和处理
 	c.scraper.Open()
+	c.pipelines.open()
 	go func() {
 		defer func() {
+			c.jobBound.release()
 			c.jobScheduler.Dispose()
 			c.scraper.Close()
-			c.itemLoopClosed = true
+			c.pipelines.close()
+			close(c.itemLoopClosed)
 			c.wg.Done()
 			c.logger.Debugln("Item Loop stopped")
 		}()
-		// 即使请求任务已经结束, 只要还有未处理完的任务就继续下去
-		// todo: 假设任务处理得非常快, 一瞬间就处理完了所有等待的任务但队列还没清空呢?
-		run := true
-		for run {
+		workers := int64(c.scraper.NumWorkers())
+		done := func(err error) {
+			if err != nil {
+				c.errs.Record(err)
+				c.stats.Inc(StatsJobError, 1)
+				c.handleError(err)
+			}
+			c.stats.Inc(StatsJobFinished, 1)
+			atomic.AddInt64(&c.inflightJobs, -1)
+			notify(c.jobSignal)
+		}
+		for {
+			// 即使请求任务已经结束, 只要还有未处理完的任务就继续下去.
+			// 任务只会在请求回调中产生, 请求循环结束后不会再有新的任务入队,
+			// 因此依次确认请求循环已结束, 没有在途的任务, 队列为空, 就说明所有任务都已处理完
+			requestLoopClosed := isClosed(c.requestLoopClosed)
+			inflight := atomic.LoadInt64(&c.inflightJobs)
+			// 请求循环结束后不再暂停, 剩余的任务全部处理完才退出
+			if inflight < workers && (requestLoopClosed || !c.Paused()) && !c.jobScheduler.Empty() {
+				job := c.jobScheduler.Get(1)[0]
+				c.jobBound.signal()
+				atomic.AddInt64(&c.inflightJobs, 1)
+				c.scraper.Send(c.safeJob(job), done)
+				continue
+			}
+			if requestLoopClosed && inflight == 0 && c.jobScheduler.Empty() {
+				return
+			}
 			select {
+			case <-c.jobSignal:
 			case <-c.stopped:
-				run = false
-			default:
-				if !c.jobScheduler.Empty() {
-					if c.scraper.NumWaitingJobs() < c.scraper.NumWorkers() {
-						job := c.jobScheduler.Get(1)[0]
-						c.scraper.Send(job)
-					}
-				} else if c.requestLoopClosed && c.scraper.NumWaitingJobs() == 0 {
-					// 请求处理已完成, 调度器已为空, 也没有在等待处理的任务, 说明所有任务已处理完且没有后续任务
-					run = false
+				return
+			}
+		}
+	}()
+}
+
+// 暂停分发新的请求和任务, 已经分发的请求和任务会正常完成, 队列中的请求和任务保持不变.
+// 暂停期间爬虫不会因为没有请求而退出, Stop 和取消 Run 的 ctx 仍然有效
+func (c *Crawler) Pause() {
+	if atomic.CompareAndSwapInt32(&c.paused, 0, 1) {
+		c.logger.Infoln("Crawler paused")
+		c.emit(Event{Signal: CrawlerPaused})
+	}
+}
+
+// 从暂停中恢复, 继续分发队列中的请求和任务
+func (c *Crawler) Resume() {
+	if atomic.CompareAndSwapInt32(&c.paused, 1, 0) {
+		notify(c.requestSignal)
+		notify(c.jobSignal)
+		c.logger.Infoln("Crawler resumed from pause")
+		c.emit(Event{Signal: CrawlerResumed})
+	}
+}
+
+// Crawler 是否处于暂停状态
+func (c *Crawler) Paused() bool {
+	return atomic.LoadInt32(&c.paused) == 1
+}
+
+// 收到 sigs 中的系统信号时切换暂停状态, 如 syscall.SIGUSR1, Crawler 结束或者调用返回的函数后不再处理信号.
+// sigs 为空时不处理任何信号
+func (c *Crawler) TogglePauseOn(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		return func() {}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	done := make(chan struct{})
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+	go func() {
+		defer stop()
+		for {
+			select {
+			case sig := <-ch:
+				c.logger.WithField("Signal", sig).Debugln("Signal received")
+				if c.Paused() {
+					c.Resume()
+				} else {
+					c.Pause()
 				}
-				c.logger.WithFields(logrus.Fields{"NumItem": c.jobScheduler.Len(), "NumWaitingJobs": c.downloader.NumWaitingJobs()}).Debugln()
+			case <-c.itemLoopClosed:
+				return
+			case <-done:
+				return
 			}
-			// goroutine 是协程, 主动释放CPU避免持续占用
-			runtime.Gosched()
 		}
 	}()
+	return stop
+}
+
+// 请求入队, 请求循环已经退出时丢弃请求并返回 false
+func (c *Crawler) putRequest(reqs []*gen.Request) bool {
+	c.disposeMu.RLock()
+	defer c.disposeMu.RUnlock()
+	if c.disposed {
+		atomic.AddInt64(&c.unscheduled, int64(len(reqs)))
+		return false
+	}
+	c.requestScheduler.Put(reqs...)
+	return true
+}
+
+// 在运行时为爬虫添加请求, 请求经过爬虫中间件后入队, 深度为 0. Crawler 已经结束时返回 ErrCrawlerClosed
+func (c *Crawler) PutRequest(s Spider, reqs ...*gen.Request) error {
+	if isClosed(c.requestLoopClosed) {
+		return ErrCrawlerClosed
+	}
+	for _, req := range reqs {
+		if err := ValidateRequest(req); err != nil {
+			return err
+		}
+	}
+	(&helper{crawler: c, spider: s}).PutRequest(c.spiderMiddlewares.processRequests(nil, reqs)...)
+	return nil
+}
+
+// 调整下载器的并发数, 下载器需要实现 ResizableDownloader
+func (c *Crawler) SetDownloaderConcurrency(n int) error {
+	rd, ok := c.downloader.(ResizableDownloader)
+	if !ok {
+		return errors.New("talpa: downloader is not resizable")
+	}
+	if err := rd.SetConcurrency(n); err != nil {
+		return err
+	}
+	notify(c.requestSignal)
+	return nil
+}
+
+// 设置保持运行的模式, 请求处理完后每隔 interval 询问一次爬虫是否有新的请求,
+// 直到爬虫被停止或者 Run 的 ctx 被取消. interval 为 0 时请求处理完后退出, 需要在爬虫启动前调用
+func (c *Crawler) SetKeepAlive(interval time.Duration) {
+	c.keepAlive = interval
+}
+
+// 设置 Crawler 的错误处理函数, 处理没有设置 ErrBack 的请求错误, 回调和任务中的 panic 等, 需要在爬虫启动前调用.
+// 处理函数会被并发调用, 错误已经被计入统计和错误汇总中
+func (c *Crawler) SetErrorHandler(h func(err error)) {
+	c.errorHandler = h
+}
+
+// 按顺序添加下载器中间件, 需要在爬虫启动前调用
+func (c *Crawler) UseDownloaderMiddleware(ms ...DownloaderMiddleware) {
+	c.downloader.Use(ms...)
+}
+
+// 按顺序添加爬虫中间件, 需要在爬虫启动前调用
+func (c *Crawler) UseSpiderMiddleware(ms ...SpiderMiddleware) {
+	c.spiderMiddlewares = append(c.spiderMiddlewares, ms...)
+}
+
+// 按顺序添加数据处理管道, 需要在爬虫启动前调用
+func (c *Crawler) UsePipeline(ps ...ItemPipeline) {
+	if c.scraper == nil {
+		c.logger.Fatalln("ItemPipeline requires a Scraper")
+	}
+	c.pipelines = append(c.pipelines, ps...)
 }
 
 // 启动一个工作队列, 如果后台工作未完成将会启动失败并返回错误
 func (c *Crawler) Start() {
-	// 添加初始请求
+	c.start(context.Background())
+}
+
+func (c *Crawler) start(ctx context.Context) {
+	c.ctx = ctx
+	c.stats.start()
+	// 调度器中还有上次运行留下的请求的爬虫直接继续抓取, 其他爬虫添加初始请求
+	resumed := c.resumedSpiders()
 	for _, s := range c.spiders {
-		c.requestScheduler.Put(s.StartRequests()...)
+		c.emit(Event{Signal: SpiderOpened, Spider: s})
+		if resumed[s] {
+			continue
+		}
+		reqs := c.spiderMiddlewares.processRequests(nil, s.StartRequests())
+		(&helper{crawler: c, spider: s}).PutRequest(reqs...)
+	}
+	if len(resumed) > 0 {
+		c.logger.WithFields(logrus.Fields{"NumRequest": c.requestScheduler.Len(), "NumSpider": len(resumed)}).Infoln("Crawler resumed")
 	}
 	// 启动核心的任务调度
 	c.loopRequest()
 	if c.scraper != nil {
 		c.loopItem()
+	} else {
+		close(c.itemLoopClosed)
 	}
 	c.logger.Infoln("Crawler started")
+	c.emit(Event{Signal: CrawlerStarted})
 }
 
-// 强制停止工作, 即使任务正在运行
+// 启动时调度器中已经有请求的爬虫. 调度器不能按爬虫统计请求时, 只要有请求就认为所有爬虫都是继续抓取
+func (c *Crawler) resumedSpiders() map[Spider]bool {
+	if c.requestScheduler.Empty() {
+		return nil
+	}
+	resumed := make(map[Spider]bool, len(c.spiders))
+	switch ss, ok := summarizedSchedulerOf(c.requestScheduler); {
+	case c.spiderScheduler != nil:
+		for _, s := range c.spiders {
+			if c.spiderScheduler.LenOf(s) > 0 {
+				resumed[s] = true
+			}
+		}
+	case ok:
+		names := make(map[string]bool)
+		for _, summary := range ss.Summary() {
+			names[summary.Spider] = true
+		}
+		for _, s := range c.spiders {
+			if names[SpiderName(s)] {
+				resumed[s] = true
+			}
+		}
+	default:
+		for _, s := range c.spiders {
+			resumed[s] = true
+		}
+	}
+	return resumed
+}
+
+// 强制停止工作, 即使任务正在运行, 可以多次调用
 func (c *Crawler) Stop() {
-	close(c.stopped)
+	c.stopOnce.Do(func() { close(c.stopped) })
 	c.Wait()
 }
 
 // 等待工作完成
 func (c *Crawler) Wait() {
 	c.wg.Wait()
-	c.logger.Infoln("Crawler stopped")
+	c.closeOnce.Do(c.close)
+}
+
+// 所有工作结束后只调用一次, 对还没有关闭的爬虫发出 SpiderClosed 信号, 输出统计信息并发出 CrawlerClosed 信号
+func (c *Crawler) close() {
+	c.stats.finish()
+	for _, s := range c.spiders {
+		c.closeSpider(c.spiderStates[s])
+	}
+	entry := c.logger
+	if stats, err := json.Marshal(c.Stats()); err == nil {
+		entry = entry.WithField("Stats", string(stats))
+	}
+	entry.Infoln("Crawler stopped")
+	c.emit(Event{Signal: CrawlerClosed})
+}
+
+// 当前统计信息的快照, 可以在运行过程中调用
+func (c *Crawler) Stats() StatsSnapshot {
+	return c.stats.Snapshot()
+}
+
+// 运行爬虫直到所有请求和任务处理完成, 或者 ctx 被取消.
+// ctx 取消后不再分发新的请求, 但已经发出的请求会正常完成并执行回调, 已经产生的任务也会全部交给 Scraper 处理,
+// 返回运行过程中出现的错误汇总, 没有错误时返回 nil
+func (c *Crawler) Run(ctx context.Context) error {
+	c.start(ctx)
+	c.Wait()
+	if s := c.errs.Summary(ctx.Err(), atomic.LoadInt64(&c.unscheduled)); s != nil {
+		return s
+	}
+	return nil
 }
 
 // NewCrawler 初始化实例, limit 为并发限制, 为 0 表示不限制
@@ -134,12 +644,22 @@ func NewCrawler(spiders []Spider, rs RequestScheduler, d Downloader, is JobSched
 	crawler := new(Crawler)
 	crawler.spiders = spiders
 	crawler.requestScheduler = rs
+	if ss, ok := spiderSchedulerOf(rs); ok {
+		crawler.spiderScheduler = ss
+	}
+	crawler.spiderStates = newSpiderStates(spiders)
 	crawler.downloader = d
 	if (is == nil) != (s == nil) {
 		Logger.Fatalln("ItemScheduler and Scraper must be provided at the same time")
 	}
 	crawler.jobScheduler = is
 	crawler.scraper = s
+	crawler.stopped = make(chan bool)
+	crawler.requestSignal = make(chan struct{}, 1)
+	crawler.jobSignal = make(chan struct{}, 1)
+	crawler.requestLoopClosed = make(chan struct{})
+	crawler.itemLoopClosed = make(chan struct{})
+	crawler.stats = NewStats()
 
 	crawler.logger = Logger.WithField("Crawler", fmt.Sprintf("%p", crawler))
 	return crawler
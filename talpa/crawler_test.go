@@ -1,9 +1,362 @@
 package talpa
 
-import "testing"
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 用于测试的爬虫, 对同一地址产生固定数量的请求, 每个响应产生一个任务
+type testSpider struct {
+	url     string
+	num     int
+	cancel  context.CancelFunc
+	parsed  int32
+	scraped int32
+}
+
+func (s *testSpider) StartRequests() []*gen.Request {
+	reqs := make([]*gen.Request, s.num)
+	for i := range reqs {
+		req := gen.NewRequest().URL(s.url)
+		MetaOf(req).CallBack = s.Parse
+		reqs[i] = req
+	}
+	return reqs
+}
+
+func (s *testSpider) Parse(res *gen.Response, h Helper) {
+	if atomic.AddInt32(&s.parsed, 1) == 1 && s.cancel != nil {
+		s.cancel()
+	}
+	h.PutJob(func() {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&s.scraped, 1)
+	})
+}
+
+func newTestServer(latency time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(latency)
+		w.Write([]byte("{}"))
+	}))
+}
+
+func TestCrawlerRunDrain(t *testing.T) {
+	ts := newTestServer(20 * time.Millisecond)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	spider := &testSpider{url: ts.URL, num: 50, cancel: cancel}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(4), NewJobScheduler(10), NewScraper(2))
+	err := crawler.Run(ctx)
+
+	summary, ok := err.(*ErrorSummary)
+	if !ok {
+		t.Fatalf("Run returns %v, *ErrorSummary expected", err)
+	}
+	if summary.Cause != context.Canceled {
+		t.Errorf("Cause is %v, %v expected", summary.Cause, context.Canceled)
+	}
+	parsed, scraped := atomic.LoadInt32(&spider.parsed), atomic.LoadInt32(&spider.scraped)
+	if parsed == int32(spider.num) || summary.NumUnscheduled == 0 {
+		t.Errorf("All requests were sent after cancel, parsed=%d unscheduled=%d", parsed, summary.NumUnscheduled)
+	}
+	if int64(parsed)+summary.NumUnscheduled != int64(spider.num) {
+		t.Errorf("Requests were lost, parsed=%d unscheduled=%d", parsed, summary.NumUnscheduled)
+	}
+	if scraped != parsed {
+		t.Errorf("Jobs were not flushed, parsed=%d scraped=%d", parsed, scraped)
+	}
+}
+
+func TestCrawlerRun(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	spider := &testSpider{url: ts.URL, num: 20}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(4), NewJobScheduler(10), NewScraper(2))
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if spider.scraped != int32(spider.num) {
+		t.Errorf("%d jobs were finished, %d expected", spider.scraped, spider.num)
+	}
+}
+
+func TestCrawlerResume(t *testing.T) {
+	ts := newTestServer(20 * time.Millisecond)
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "talpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	spider := &testSpider{url: ts.URL, num: 50, cancel: cancel}
+	rs, err := NewDiskRequestScheduler(dir, gen.NewRequest(), spider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crawler := NewCrawler([]Spider{spider}, rs, NewDownloader(4), NewJobScheduler(10), NewScraper(2))
+	err = crawler.Run(ctx)
+	summary, ok := err.(*ErrorSummary)
+	if !ok || summary.NumUnscheduled == 0 {
+		t.Fatalf("Run returns %v, unscheduled requests expected", err)
+	}
+
+	// 使用同一目录从上次结束的地方继续抓取
+	spider.cancel = nil
+	rs, err = NewDiskRequestScheduler(dir, gen.NewRequest(), spider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Len() != summary.NumUnscheduled {
+		t.Errorf("%d requests were loaded, %d expected", rs.Len(), summary.NumUnscheduled)
+	}
+	crawler = NewCrawler([]Spider{spider}, rs, NewDownloader(4), NewJobScheduler(10), NewScraper(2))
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if spider.parsed != int32(spider.num) || spider.scraped != int32(spider.num) {
+		t.Errorf("parsed=%d scraped=%d, %d expected", spider.parsed, spider.scraped, spider.num)
+	}
+}
+
+func TestCrawlerPause(t *testing.T) {
+	ts := newTestServer(10 * time.Millisecond)
+	defer ts.Close()
+
+	spider := &testSpider{url: ts.URL, num: 20}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	// 第一个响应解析后暂停
+	spider.cancel = crawler.Pause
+	var paused, resumed int32
+	pausedSignal := make(chan struct{}, 1)
+	crawler.Connect(CrawlerPaused, func(e *Event) {
+		atomic.AddInt32(&paused, 1)
+		pausedSignal <- struct{}{}
+	})
+	crawler.Connect(CrawlerResumed, func(e *Event) { atomic.AddInt32(&resumed, 1) })
+	crawler.Start()
+
+	select {
+	case <-pausedSignal:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CrawlerPaused was not sent")
+	}
+	// 暂停时在途的请求会正常完成, 之后不再发送新的请求
+	deadline := time.Now().Add(5 * time.Second)
+	for crawler.numInflightRequests() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Inflight requests were not finished while paused")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	parsed := atomic.LoadInt32(&spider.parsed)
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&spider.parsed); !crawler.Paused() || n != parsed {
+		t.Errorf("Paused=%v, parsed changed from %d to %d while paused", crawler.Paused(), parsed, n)
+	}
+	if scraped := atomic.LoadInt32(&spider.scraped); scraped != 0 {
+		t.Errorf("%d jobs were finished while paused, 0 expected", scraped)
+	}
+	if crawler.Closed() || crawler.requestScheduler.Len() != int64(spider.num)-int64(parsed) {
+		t.Errorf("Queue was not kept while paused, closed=%v queued=%d", crawler.Closed(), crawler.requestScheduler.Len())
+	}
+
+	crawler.Resume()
+	crawler.Wait()
+	if spider.parsed != int32(spider.num) || spider.scraped != int32(spider.num) {
+		t.Errorf("parsed=%d scraped=%d, %d expected", spider.parsed, spider.scraped, spider.num)
+	}
+	if paused != 1 || resumed != 1 {
+		t.Errorf("CrawlerPaused was sent %d times and CrawlerResumed %d times, 1 expected", paused, resumed)
+	}
+}
+
+const (
+	benchRequests = 100
+	benchLatency  = 2 * time.Millisecond
+)
+
+// 记录每次抓取消耗的CPU时间, 分发循环空转时CPU时间会远大于实际处理请求的时间
+func reportCPU(b *testing.B, start time.Duration) {
+	b.ReportMetric(float64(cpuTime()-start)/float64(time.Millisecond)/float64(b.N), "cpu-ms/op")
+}
 
-// todo: Crawler性能测试
 // 测试顺序抓取的性能, 用于和Crawler的性能进行比较
-func BenchmarkSequentiallyCrawl(b *testing.B) {}
+func BenchmarkSequentiallyCrawl(b *testing.B) {
+	Logger.Level = logrus.WarnLevel
+	defer func() { Logger.Level = logrus.InfoLevel }()
+	ts := newTestServer(benchLatency)
+	defer ts.Close()
+
+	b.ResetTimer()
+	start := cpuTime()
+	for i := 0; i < b.N; i++ {
+		spider := &testSpider{url: ts.URL, num: benchRequests}
+		for _, req := range spider.StartRequests() {
+			res, err := req.Do()
+			if err != nil {
+				b.Fatal(err)
+			}
+			MetaOf(req).CallBack(res, sequentialHelper{})
+		}
+	}
+	reportCPU(b, start)
+}
+
+// 顺序抓取时直接执行任务
+type sequentialHelper struct{}
+
+func (sequentialHelper) PutRequest(reqs ...*gen.Request) {}
+func (sequentialHelper) PutItem(items ...Item)           {}
+func (sequentialHelper) Stats() *Stats                   { return NewStats() }
+func (sequentialHelper) PutJob(jobs ...func()) {
+	for _, job := range jobs {
+		job()
+	}
+}
+
+func BenchmarkCrawler(b *testing.B) {
+	Logger.Level = logrus.WarnLevel
+	defer func() { Logger.Level = logrus.InfoLevel }()
+	ts := newTestServer(benchLatency)
+	defer ts.Close()
+
+	b.ResetTimer()
+	start := cpuTime()
+	for i := 0; i < b.N; i++ {
+		spider := &testSpider{url: ts.URL, num: benchRequests}
+		crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(8), NewJobScheduler(10), NewScraper(8))
+		if err := crawler.Run(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	reportCPU(b, start)
+}
+
+// 空闲时再产生请求的爬虫, 产生 polls 次请求后不再产生, 由测试取消运行
+type pollSpider struct {
+	testSpider
+	polls  int32
+	polled int32
+}
+
+func (s *pollSpider) Idle() []*gen.Request {
+	if atomic.LoadInt32(&s.polled) >= s.polls {
+		return nil
+	}
+	atomic.AddInt32(&s.polled, 1)
+	return s.StartRequests()
+}
+
+func TestCrawlerKeepAlive(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	spider := &pollSpider{testSpider: testSpider{url: ts.URL, num: 1}, polls: 3}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	crawler.SetKeepAlive(10 * time.Millisecond)
+	go func() {
+		// 所有请求都处理完后爬虫仍然在运行, 直到被取消
+		for atomic.LoadInt32(&spider.scraped) < 4 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if crawler.Closed() {
+			t.Error("Crawler was closed in keep-alive mode")
+		}
+		cancel()
+	}()
+	err := crawler.Run(ctx)
+	if summary, ok := err.(*ErrorSummary); !ok || summary.Cause != context.Canceled {
+		t.Errorf("Run returns %v, canceled summary expected", err)
+	}
+	if spider.parsed != 4 {
+		t.Errorf("%d responses were parsed, 4 expected", spider.parsed)
+	}
+
+	// 没有保持运行时不调用 Idle, 处理完初始请求后退出
+	spider = &pollSpider{testSpider: testSpider{url: ts.URL, num: 1}, polls: 3}
+	crawler = NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if spider.polled != 0 || spider.parsed != 1 {
+		t.Errorf("Idle was called %d times and %d responses were parsed without keep-alive", spider.polled, spider.parsed)
+	}
+}
+
+// 回调和任务都会 panic 的爬虫, 偶数请求设置了 ErrBack
+type panicSpider struct {
+	url      string
+	num      int
+	errBacks int32
+}
+
+func (s *panicSpider) StartRequests() []*gen.Request {
+	reqs := make([]*gen.Request, s.num)
+	for i := range reqs {
+		req := gen.NewRequest().URL(s.url)
+		MetaOf(req).CallBack = s.Parse
+		if i%2 == 0 {
+			MetaOf(req).ErrBack = s.ErrBack
+		}
+		reqs[i] = req
+	}
+	return reqs
+}
+
+func (s *panicSpider) Parse(res *gen.Response, h Helper) {
+	h.PutJob(func() { panic("job") })
+	Logger.Panicln("callback")
+}
+
+func (s *panicSpider) ErrBack(res *gen.Response) {
+	if perr, ok := res.Error.(*PanicError); ok && perr.Error() == "talpa: panic: callback" && len(perr.Stack) > 0 {
+		atomic.AddInt32(&s.errBacks, 1)
+	}
+}
+
+func TestCrawlerPanicIsolation(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	spider := &panicSpider{url: ts.URL, num: 4}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	var handled int32
+	crawler.SetErrorHandler(func(err error) {
+		if _, ok := err.(*PanicError); ok {
+			atomic.AddInt32(&handled, 1)
+		}
+	})
+	err := crawler.Run(context.Background())
 
-func BenchmarkCrawler(b *testing.B) {}
+	summary, ok := err.(*ErrorSummary)
+	if !ok || summary.NumErrors != 8 {
+		t.Fatalf("Run returns %v, 8 errors expected", err)
+	}
+	// 4 个任务和 2 个没有 ErrBack 的回调交给 Crawler 的错误处理函数
+	if spider.errBacks != 2 || handled != 6 {
+		t.Errorf("%d errors were handled by ErrBack, %d by crawler, 2 and 6 expected", spider.errBacks, handled)
+	}
+	stats := crawler.Stats()
+	if stats.Counters[StatsCallbackError] != 4 || stats.Counters[StatsJobError] != 4 {
+		t.Errorf("Errors were not counted: %v", stats.Counters)
+	}
+}
@@ -0,0 +1,41 @@
+package talpa
+
+import (
+	"github.com/Sirupsen/logrus"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+type depthMiddleware struct {
+	BaseSpiderMiddleware
+	maxDepth int
+	priority int
+
+	logger *logrus.Entry
+}
+
+// 回调产生的请求深度为响应对应的请求深度加 1, 与 Helper 入队时记录的深度一致
+func (m *depthMiddleware) ProcessRequests(res *gen.Response, reqs []*gen.Request) []*gen.Request {
+	depth := 0
+	if res != nil {
+		depth = ResponseMeta(res).Depth + 1
+	}
+	if m.maxDepth > 0 && depth > m.maxDepth {
+		m.logger.WithField("NumRequest", len(reqs)).Debugln("Requests were dropped")
+		return nil
+	}
+	if m.priority != 0 {
+		for _, req := range reqs {
+			MetaOf(req).Priority -= depth * m.priority
+		}
+	}
+	return reqs
+}
+
+// 根据请求深度进行限制和调整优先级的爬虫中间件.
+// maxDepth 为允许的最大深度, 为 0 表示不限制; 每深一层请求的优先级减少 priority,
+// 为正数时较浅的请求先发送, 接近广度优先, 为负数时较深的请求先发送, 接近深度优先
+func NewDepthMiddleware(maxDepth, priority int) SpiderMiddleware {
+	m := &depthMiddleware{maxDepth: maxDepth, priority: priority}
+	m.logger = Logger.WithFields(logrus.Fields{"SpiderMiddleware": "Depth", "MaxDepth": maxDepth})
+	return m
+}
@@ -0,0 +1,67 @@
+package talpa
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 每个响应都产生一个新的请求, 记录每个响应对应的请求深度
+type chainSpider struct {
+	url    string
+	mu     sync.Mutex
+	depths []int
+}
+
+func (s *chainSpider) StartRequests() []*gen.Request {
+	req := gen.NewRequest().URL(s.url)
+	MetaOf(req).CallBack = s.Parse
+	return []*gen.Request{req}
+}
+
+func (s *chainSpider) Parse(res *gen.Response, h Helper) {
+	s.mu.Lock()
+	s.depths = append(s.depths, ResponseMeta(res).Depth)
+	s.mu.Unlock()
+	h.PutRequest(s.StartRequests()...)
+}
+
+func TestCrawlerDepth(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	spider := &chainSpider{url: ts.URL}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	crawler.UseSpiderMiddleware(NewDepthMiddleware(3, 0))
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(spider.depths) != 4 {
+		t.Fatalf("Depths are %v, 0 to 3 expected", spider.depths)
+	}
+	for i, depth := range spider.depths {
+		if depth != i {
+			t.Errorf("Depth of response %d is %d", i, depth)
+		}
+	}
+	if max := crawler.Stats().MaxValues[StatsRequestDepth]; max != 3 {
+		t.Errorf("Max depth is %d, 3 expected", max)
+	}
+}
+
+func TestDepthMiddlewarePriority(t *testing.T) {
+	parent := gen.NewRequest()
+	MetaOf(parent).Depth = 1
+	res := &gen.Response{Context: parent.Context}
+	for _, c := range []struct {
+		priority, expected int
+	}{{1, -2}, {-1, 2}, {0, 0}} {
+		req := gen.NewRequest()
+		NewDepthMiddleware(0, c.priority).ProcessRequests(res, []*gen.Request{req})
+		if pri := MetaOf(req).Priority; pri != c.expected {
+			t.Errorf("Priority of depth 2 is %d with depth priority %d, %d expected", pri, c.priority, c.expected)
+		}
+	}
+}
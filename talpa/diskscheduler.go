@@ -0,0 +1,297 @@
+package talpa
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 持久化的请求, 回调函数使用爬虫名称和方法名称表示
+type diskRequest struct {
+	Method     string
+	URL        string
+	Header     http.Header
+	Body       []byte
+	Priority   int
+	Depth      int    `json:",omitempty"`
+	RetryTimes int    `json:",omitempty"`
+	DontFilter bool   `json:",omitempty"`
+	Endpoint   string `json:",omitempty"`
+	Spider     string
+	CallBack   string
+	ErrBack    string `json:",omitempty"`
+}
+
+// 请求对应的持久化文件名, 保存在请求的 Context 中
+type diskFileKey struct{}
+
+// 得到方法值对应的方法名, 回调必须是爬虫的方法才能被持久化
+func methodName(f interface{}) (string, error) {
+	return methodNameOf(runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name())
+}
+
+// 从函数名中得到方法名, 方法值的函数名形如 "pkg.(*Type).Method-fm"
+func methodNameOf(name string) (string, error) {
+	if !strings.HasSuffix(name, "-fm") {
+		return "", fmt.Errorf("%s is not a method value", name)
+	}
+	name = strings.TrimSuffix(name, "-fm")
+	return name[strings.LastIndex(name, ".")+1:], nil
+}
+
+// 根据方法名得到爬虫的方法, 方法不存在时返回 nil
+func spiderMethod(s Spider, name string) interface{} {
+	m := reflect.ValueOf(s).MethodByName(name)
+	if !m.IsValid() {
+		return nil
+	}
+	return m.Interface()
+}
+
+func newDiskRequest(req *gen.Request) (*diskRequest, error) {
+	meta := MetaOf(req)
+	if meta.Spider == nil {
+		return nil, fmt.Errorf("Spider of request %p is not set", req)
+	}
+	if meta.CallBack == nil {
+		return nil, fmt.Errorf("CallBack of request %p is not set", req)
+	}
+	raw, err := RawRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	dr := &diskRequest{
+		Method:     raw.Method,
+		URL:        raw.URL.String(),
+		Header:     raw.Header,
+		Spider:     SpiderName(meta.Spider),
+		Priority:   meta.Priority,
+		Depth:      meta.Depth,
+		RetryTimes: meta.RetryTimes,
+		DontFilter: meta.DontFilter,
+		Endpoint:   Endpoint(req),
+	}
+	if raw.Body != nil {
+		dr.Body, err = ioutil.ReadAll(raw.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dr.CallBack, err = methodName(meta.CallBack); err != nil {
+		return nil, fmt.Errorf("CallBack: %s", err)
+	}
+	if meta.ErrBack != nil {
+		if dr.ErrBack, err = methodName(meta.ErrBack); err != nil {
+			return nil, fmt.Errorf("ErrBack: %s", err)
+		}
+	}
+	return dr, nil
+}
+
+// 持久化请求的恢复, 恢复的请求通过 base.Clone() 生成, 回调函数从同名爬虫的方法中得到
+type requestCodec struct {
+	base    *gen.Request
+	spiders map[string]Spider
+}
+
+func newRequestCodec(base *gen.Request, spiders []Spider) (*requestCodec, error) {
+	rc := &requestCodec{base: base, spiders: make(map[string]Spider, len(spiders))}
+	for _, s := range spiders {
+		name := SpiderName(s)
+		if _, ok := rc.spiders[name]; ok {
+			return nil, fmt.Errorf("Duplicate spider name %q", name)
+		}
+		rc.spiders[name] = s
+	}
+	return rc, nil
+}
+
+type diskRequestScheduler struct {
+	*requestScheduler
+	*requestCodec
+	dir string
+	seq int64
+}
+
+var _ RequestScheduler = (*diskRequestScheduler)(nil)
+
+// 根据持久化的请求重新生成请求对象, 回调函数从对应的爬虫的方法中得到
+func (rc *requestCodec) restore(dr *diskRequest) (*gen.Request, error) {
+	s, ok := rc.spiders[dr.Spider]
+	if !ok {
+		return nil, fmt.Errorf("Spider %q not found", dr.Spider)
+	}
+	callBack, ok := spiderMethod(s, dr.CallBack).(func(*gen.Response, Helper))
+	if !ok {
+		return nil, fmt.Errorf("CallBack %q of spider %q not found", dr.CallBack, dr.Spider)
+	}
+	req := cloneRequest(rc.base)
+	req.Method(dr.Method)
+	req.URL(dr.URL)
+	for k, vs := range dr.Header {
+		req.DelHeader(k)
+		for _, v := range vs {
+			req.AddHeader(k, v)
+		}
+	}
+	if len(dr.Body) > 0 {
+		req.BodyString(string(dr.Body))
+	}
+	meta := &RequestMeta{
+		CallBack:   callBack,
+		Priority:   dr.Priority,
+		Depth:      dr.Depth,
+		Spider:     s,
+		RetryTimes: dr.RetryTimes,
+		DontFilter: dr.DontFilter,
+		scheduled:  true,
+	}
+	if dr.ErrBack != "" {
+		if meta.ErrBack, ok = spiderMethod(s, dr.ErrBack).(func(*gen.Response)); !ok {
+			return nil, fmt.Errorf("ErrBack %q of spider %q not found", dr.ErrBack, dr.Spider)
+		}
+	}
+	req.Context.Set(metaKey{}, meta)
+	if dr.Endpoint != "" {
+		req.Context.Set("Endpoint", dr.Endpoint)
+	}
+	return req, nil
+}
+
+func (rs *diskRequestScheduler) Put(reqs ...*gen.Request) {
+	for _, req := range reqs {
+		if req == nil {
+			rs.logger.Panicln("Cann't push a nil request into queue!")
+		}
+		dr, err := newDiskRequest(req)
+		if err != nil {
+			rs.logger.Panicln(err)
+		}
+		data, err := json.Marshal(dr)
+		if err != nil {
+			rs.logger.Panicln(err)
+		}
+		// 文件名按入队顺序递增, 载入时保持原来的顺序
+		name := fmt.Sprintf("%020d.json", atomic.AddInt64(&rs.seq, 1))
+		if err := writeFileAtomic(path.Join(rs.dir, name), data); err != nil {
+			rs.logger.Panicln(err)
+		}
+		req.Context.Set(diskFileKey{}, name)
+	}
+	rs.requestScheduler.Put(reqs...)
+}
+
+// 先写入同一目录下的临时文件再重命名, 程序在写入过程中崩溃时不会留下不完整的请求文件
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// 读取并恢复一个请求文件
+func (rs *diskRequestScheduler) load(name string) (*gen.Request, error) {
+	data, err := ioutil.ReadFile(path.Join(rs.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	dr := new(diskRequest)
+	if err := json.Unmarshal(data, dr); err != nil {
+		return nil, err
+	}
+	req, err := rs.restore(dr)
+	if err != nil {
+		return nil, err
+	}
+	req.Context.Set(diskFileKey{}, name)
+	return req, nil
+}
+
+// 取出的请求会从磁盘中删除, 已经取出但还没有处理完的请求在程序崩溃时会丢失
+func (rs *diskRequestScheduler) Get(number int64) []*gen.Request {
+	reqs := rs.requestScheduler.Get(number)
+	for _, req := range reqs {
+		if name, ok := req.Context.Get(diskFileKey{}).(string); ok {
+			if err := os.Remove(path.Join(rs.dir, name)); err != nil {
+				rs.logger.Errorln(err)
+			}
+		}
+	}
+	return reqs
+}
+
+// 释放调度器时磁盘中的请求会被保留, 下次使用同一目录时继续抓取
+func (rs *diskRequestScheduler) Dispose() {
+	num := rs.Len()
+	rs.pq.Dispose()
+	rs.logger.WithField("NumRequest", num).Infoln("RequestScheduler disposed")
+}
+
+// 将请求持久化到 dir 目录下的请求调度器, 用于程序崩溃或重启后恢复抓取.
+// 请求的 CallBack 和 ErrBack 必须是所属爬虫的方法, 自定义的元数据不会被保存, 恢复时从 spiders 中找到同名的爬虫得到回调函数,
+// 恢复的请求通过 base.Clone() 生成, 以便保留 base 中设置的插件
+func NewDiskRequestScheduler(dir string, base *gen.Request, spiders ...Spider) (RequestScheduler, error) {
+	dir = path.Join(dir, "requests")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	rc, err := newRequestCodec(base, spiders)
+	if err != nil {
+		return nil, err
+	}
+	rs := new(diskRequestScheduler)
+	rs.dir = dir
+	rs.requestCodec = rc
+	rs.requestScheduler = NewRequestScheduler(0).(*requestScheduler)
+	rs.logger = Logger.WithField("RequestScheduler", fmt.Sprintf("%p", rs))
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		switch {
+		case f.IsDir():
+		case strings.HasSuffix(f.Name(), ".json"):
+			names = append(names, f.Name())
+		case strings.HasSuffix(f.Name(), ".json.tmp"):
+			// 上次运行在写入时崩溃留下的临时文件
+			os.Remove(path.Join(dir, f.Name()))
+		}
+	}
+	sort.Strings(names)
+	reqs := make([]*gen.Request, 0, len(names))
+	for _, name := range names {
+		// 序号需要大于所有已有的文件, 包括不能恢复的文件, 避免覆盖
+		fmt.Sscanf(name, "%d.json", &rs.seq)
+		req, err := rs.load(name)
+		if err != nil {
+			// 单个文件损坏或者所属的爬虫已经不存在时跳过, 文件保留在目录中便于排查
+			rs.logger.WithFields(logrus.Fields{"File": name, "Error": err}).Errorln("Request was not restored")
+			continue
+		}
+		reqs = append(reqs, req)
+	}
+	if len(reqs) > 0 {
+		rs.requestScheduler.Put(reqs...)
+	}
+	rs.logger.WithFields(logrus.Fields{"Dir": dir, "NumRequest": len(reqs)}).Infoln("RequestScheduler loaded")
+	return rs, nil
+}
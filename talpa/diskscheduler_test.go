@@ -0,0 +1,196 @@
+package talpa
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+type namedSpider struct {
+	name string
+}
+
+func (s *namedSpider) StartRequests() []*gen.Request     { return nil }
+func (s *namedSpider) Name() string                      { return s.name }
+func (s *namedSpider) Parse(res *gen.Response, h Helper) {}
+func (s *namedSpider) Fail(res *gen.Response)            {}
+
+func TestDiskRequestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spiders := []Spider{&namedSpider{"a"}, &namedSpider{"b"}}
+	rs, err := NewDiskRequestScheduler(dir, gen.NewRequest(), spiders...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := newPostRequest("http://www.example.com/?id=1", "a=1").SetHeader("X-Test", "test")
+	req.Context.Set("Spider", spiders[1])
+	req.Context.Set("CallBack", spiders[1].(*namedSpider).Parse)
+	req.Context.Set("ErrBack", spiders[1].(*namedSpider).Fail)
+	req.Context.Set("Priority", 3)
+	rs.Put(req)
+
+	closure := newPostRequest("http://www.example.com/", "")
+	closure.Context.Set("Spider", spiders[0])
+	closure.Context.Set("CallBack", func(*gen.Response, Helper) {})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Closure CallBack was persisted")
+			}
+		}()
+		rs.Put(closure)
+	}()
+	rs.Dispose()
+
+	rs, err = NewDiskRequestScheduler(dir, gen.NewRequest(), spiders...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Len() != 1 {
+		t.Fatalf("%d requests were loaded, 1 expected", rs.Len())
+	}
+	restored := rs.Get(1)[0]
+	if spiderOf(restored) != spiders[1] {
+		t.Errorf("Spider is %v, %v expected", spiderOf(restored), spiders[1])
+	}
+	meta := MetaOf(restored)
+	if meta.CallBack == nil {
+		t.Error("CallBack was not restored")
+	}
+	if meta.ErrBack == nil {
+		t.Error("ErrBack was not restored")
+	}
+	if meta.Priority != 3 {
+		t.Errorf("Priority is %v, 3 expected", meta.Priority)
+	}
+	origin, _ := Fingerprint(req)
+	fp, err := Fingerprint(restored)
+	if err != nil || fp != origin {
+		t.Errorf("Restored request is different from the origin one, %s", err)
+	}
+	raw, _ := RawRequest(restored)
+	if raw.Header.Get("X-Test") != "test" {
+		t.Errorf("Header is %v", raw.Header)
+	}
+	rs.Dispose()
+
+	// 取出的请求不会再被载入
+	rs, err = NewDiskRequestScheduler(dir, gen.NewRequest(), spiders...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.Empty() {
+		t.Errorf("%d requests were loaded, 0 expected", rs.Len())
+	}
+}
+
+func TestDiskRequestSchedulerCorrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spider := &namedSpider{"a"}
+	rs, err := NewDiskRequestScheduler(dir, gen.NewRequest(), spider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req := gen.NewRequest().URL("http://www.example.com/")
+		MetaOf(req).Spider = spider
+		MetaOf(req).CallBack = spider.Parse
+		rs.Put(req)
+	}
+	rs.Dispose()
+	// 模拟写入时崩溃留下的不完整文件和临时文件
+	files, _ := ioutil.ReadDir(path.Join(dir, "requests"))
+	if len(files) != 2 {
+		t.Fatalf("%d files were written, 2 expected", len(files))
+	}
+	name := path.Join(dir, "requests", files[0].Name())
+	ioutil.WriteFile(name, []byte(`{"Method":"GE`), 0644)
+	ioutil.WriteFile(name+".tmp", []byte(`{`), 0644)
+
+	rs, err = NewDiskRequestScheduler(dir, gen.NewRequest(), spider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Len() != 1 {
+		t.Errorf("%d requests were loaded, 1 expected", rs.Len())
+	}
+	if _, err := os.Stat(name + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Temporary file was not removed")
+	}
+	// 新的请求不会覆盖不能恢复的文件
+	req := gen.NewRequest().URL("http://www.example.com/")
+	MetaOf(req).Spider = spider
+	MetaOf(req).CallBack = spider.Parse
+	rs.Put(req)
+	if files, _ := ioutil.ReadDir(path.Join(dir, "requests")); len(files) != 3 {
+		t.Errorf("%d files in the directory, 3 expected", len(files))
+	}
+	rs.Dispose()
+}
+
+// 记录 StartRequests 调用次数的爬虫
+type resumeSpider struct {
+	namedSpider
+	url     string
+	started int32
+}
+
+func (s *resumeSpider) StartRequests() []*gen.Request {
+	atomic.AddInt32(&s.started, 1)
+	req := gen.NewRequest().URL(s.url)
+	MetaOf(req).CallBack = s.Parse
+	return []*gen.Request{req}
+}
+
+func TestCrawlerResumeNewSpider(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "talpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 上次运行只有爬虫 a, 留下了一个请求
+	a := &resumeSpider{namedSpider: namedSpider{"a"}, url: ts.URL}
+	rs, err := NewDiskRequestScheduler(dir, gen.NewRequest(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := a.StartRequests()[0]
+	MetaOf(req).Spider = a
+	rs.Put(req)
+	rs.Dispose()
+
+	a.started = 0
+	b := &resumeSpider{namedSpider: namedSpider{"b"}, url: ts.URL}
+	rs, err = NewDiskRequestScheduler(dir, gen.NewRequest(), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crawler := NewCrawler([]Spider{a, b}, rs, NewDownloader(2), nil, nil)
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if a.started != 0 || b.started != 1 {
+		t.Errorf("StartRequests was called %d times for resumed spider and %d times for new spider, 0 and 1 expected", a.started, b.started)
+	}
+	if sent := crawler.Stats().Counters[StatsRequestSent]; sent != 2 {
+		t.Errorf("%d requests were sent, 2 expected", sent)
+	}
+}
@@ -2,6 +2,8 @@ package talpa
 
 import (
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/jeffail/tunny"
@@ -11,30 +13,49 @@ import (
 type Downloader interface {
 	Open()
 	Close()
-	Fetch(req *gen.Request, h Helper)
+	// 异步发送请求, 请求处理完成后调用 done, 请求出错时 err 为发送请求时产生的错误.
+	// 请求被中间件丢弃时 res 为 nil, err 为 ErrDropRequest,
+	// 重新入队时 res 和 err 都为 nil, 重新入队的请求通过 h 入队
+	Fetch(req *gen.Request, h Helper, done func(res *gen.Response, err error))
+	// 添加下载器中间件, 需要在 Open 之前调用
+	Use(ms ...DownloaderMiddleware)
 	NumWaitingJobs() int
 	NumWorkers() int
 }
 
-// 默认的请求出错处理函数
-var DefaultErrBack = func(res *gen.Response) {
-	Logger.Errorln(res.Error)
+// 可以在运行时调整并发数的下载器, 调整后 NumWorkers 返回新的并发数
+type ResizableDownloader interface {
+	Downloader
+	SetConcurrency(n int) error
 }
 
-type downloadWorker struct{}
+// 按主机或者接口限速的下载器, 等待限速的请求不占用工作池, Crawler 分发请求时不把它们计入并发,
+// 避免一个被限速的主机占满并发而阻塞其他主机的请求. 设置了请求队列容量时等待限速的请求计入队列的长度
+type ThrottledDownloader interface {
+	Downloader
+	// 正在等待限速的请求数量
+	NumThrottled() int
+	// 设置等待限速的请求数量变化时调用的函数, 用于唤醒 Crawler 的分发循环, 需要在 Open 之前调用
+	OnThrottled(f func())
+}
+
+type downloadWorker struct {
+	d *downloader
+}
 
+// 发送请求的结果, 请求出错时 res 可能为 nil
+type fetchResult struct {
+	res     *gen.Response
+	err     error
+	latency time.Duration
+}
+
+// 工作池只用于发送请求, 中间件和限速的等待都在工作池之外进行
 func (w downloadWorker) TunnyJob(data interface{}) interface{} {
 	req := data.(*gen.Request)
+	start := time.Now()
 	res, err := req.Do()
-	if err != nil {
-		errBack := DefaultErrBack
-		if raw, ok := res.Context.GetOk("ErrBack"); ok {
-			errBack = raw.(func(*gen.Response))
-		}
-		errBack(res)
-		return nil
-	}
-	return res
+	return fetchResult{res, err, time.Since(start)}
 }
 func (w downloadWorker) TunnyReady() bool {
 	return true
@@ -42,11 +63,22 @@ func (w downloadWorker) TunnyReady() bool {
 
 type downloader struct {
 	pool *tunny.WorkPool
+	// 工作池按最大并发创建, 实际的并发由 Crawler 按 NumWorkers 控制在途请求数量实现
+	size        int
+	concurrency int64
+	throttle    *throttle
+	throttled   int64
+	onThrottled func()
+	limiter     *rateLimiter
+	middlewares downloaderMiddlewares
 
 	logger *logrus.Entry
 }
 
-var _ Downloader = (*downloader)(nil)
+var (
+	_ ResizableDownloader = (*downloader)(nil)
+	_ ThrottledDownloader = (*downloader)(nil)
+)
 
 func (d *downloader) Open() {
 	_, err := d.pool.Open()
@@ -62,35 +94,121 @@ func (d *downloader) Close() {
 	}
 	d.logger.Infoln("Downloader closed")
 }
-func (d *downloader) Fetch(req *gen.Request, h Helper) {
+func (d *downloader) Use(ms ...DownloaderMiddleware) {
+	d.middlewares = append(d.middlewares, ms...)
+}
+
+// 等待限速后在工作池中发送请求, 等待期间计入 NumThrottled
+func (d *downloader) send(req *gen.Request) (*gen.Response, error) {
+	throttled := false
+	onWait := func() {
+		if !throttled {
+			throttled = true
+			atomic.AddInt64(&d.throttled, 1)
+			if d.onThrottled != nil {
+				d.onThrottled()
+			}
+		}
+	}
+	// 记录限速等待的时间用于统计
+	if key, wait := d.limiter.wait(req, onWait); key != "" {
+		req.Context.Set("RateLimit", key)
+		req.Context.Set("RateLimitWait", wait)
+	}
+	slot := d.throttle.acquire(req, onWait)
+	if throttled {
+		atomic.AddInt64(&d.throttled, -1)
+		if d.onThrottled != nil {
+			d.onThrottled()
+		}
+	}
+	data, err := d.pool.SendWork(req)
+	if err != nil {
+		// 工作池出错时请求没有被发送, 当作请求出错处理
+		d.throttle.release(slot, 0, nil, err)
+		d.logger.WithFields(logrus.Fields{"Request": fmt.Sprintf("%p", req), "Error": err}).Errorln("Request was not sended")
+		return nil, err
+	}
+	result := data.(fetchResult)
+	d.throttle.release(slot, result.latency, result.res, result.err)
+	// 记录请求的延迟用于统计, 不包括在下载器中排队和限速等待的时间
+	req.Context.Set("Latency", result.latency)
+	return result.res, result.err
+}
+func (d *downloader) Fetch(req *gen.Request, h Helper, done func(res *gen.Response, err error)) {
 	entry := d.logger.WithField("Request", fmt.Sprintf("%p", req))
-	d.pool.SendWorkAsync(req, func(data interface{}, err error) {
-		if err != nil {
-			d.logger.Panicln(err)
+	go func() {
+		res, err := d.middlewares.process(req, d.send)
+		switch e := err.(type) {
+		case nil:
+			entry.Debugln("Request was sended")
+			done(res, nil)
+		case *RescheduleError:
+			// 等待一段时间后重新入队, 等待期间请求仍然算作没有处理完成
+			entry.WithFields(logrus.Fields{"RetryTimes": RetryTimes(e.Request.Context), "Delay": e.Delay}).Debugln("Request was rescheduled")
+			time.AfterFunc(e.Delay, func() {
+				h.PutRequest(e.Request)
+				done(nil, nil)
+			})
+		default:
+			if e == ErrDropRequest {
+				entry.Debugln("Request was dropped")
+				done(nil, e)
+				return
+			}
+			entry.Debugln("Request was failed")
+			if res == nil {
+				res = errorResponse(req, e)
+			}
+			done(res, e)
 		}
-		res := data.(*gen.Response)
-		entry.Debugln("Request was sended")
-		// CallBack 不能为空
-		callBack := res.Context.Get("CallBack").(func(*gen.Response, Helper))
-		callBack(res, h)
-		entry.Debugln("Request was processed")
-	})
+	}()
 	entry.Debugln("Request was dispatched")
 }
+
+// 等待限速和等待工作池的请求数量
 func (d *downloader) NumWaitingJobs() int {
-	return int(d.pool.NumPendingAsyncJobs())
+	return int(d.pool.NumPendingAsyncJobs()) + d.NumThrottled()
+}
+func (d *downloader) NumThrottled() int {
+	return int(atomic.LoadInt64(&d.throttled))
+}
+func (d *downloader) OnThrottled(f func()) {
+	d.onThrottled = f
 }
 func (d *downloader) NumWorkers() int {
-	return d.pool.NumWorkers()
+	return int(atomic.LoadInt64(&d.concurrency))
+}
+
+// 并发数必须在 1 到 DownloaderOptions.MaxConcurrency 之间, 减少并发时已经发出的请求不受影响
+func (d *downloader) SetConcurrency(n int) error {
+	if n <= 0 || n > d.size {
+		return fmt.Errorf("talpa: downloader concurrency must be between 1 and %d, got %d", d.size, n)
+	}
+	atomic.StoreInt64(&d.concurrency, int64(n))
+	d.logger.WithField("Concurrency", n).Infoln("Downloader concurrency changed")
+	return nil
 }
 func NewDownloader(limit int) Downloader {
-	if limit <= 0 {
+	return NewDownloaderWithOptions(DownloaderOptions{Concurrency: limit})
+}
+
+// 根据配置生成下载器, 可以对每个主机的并发和请求间隔进行限制
+func NewDownloaderWithOptions(opts DownloaderOptions) Downloader {
+	if opts.Concurrency <= 0 {
 		Logger.Fatalln("Downloader 并发必须为正整数")
 	}
 	d := new(downloader)
-	workers := make([]tunny.TunnyWorker, limit)
+	d.throttle = newThrottle(opts)
+	d.limiter = newRateLimiter(opts.RateLimits)
+	d.size = opts.Concurrency
+	if opts.MaxConcurrency > d.size {
+		d.size = opts.MaxConcurrency
+	}
+	d.concurrency = int64(opts.Concurrency)
+	workers := make([]tunny.TunnyWorker, d.size)
 	for i := range workers {
-		workers[i] = downloadWorker{}
+		workers[i] = downloadWorker{d}
 	}
 	d.pool = tunny.CreateCustomPool(workers)
 
@@ -0,0 +1,145 @@
+package talpa
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 用于过滤重复请求的接口, 请求根据指纹判断是否重复
+// 在请求的 Context 中设置 "DontFilter" 为 true 可以跳过过滤
+type DupeFilter interface {
+	// 请求已经出现过时返回 true, 否则记录这个请求并返回 false
+	RequestSeen(req *gen.Request) bool
+	// 被过滤掉的重复请求数量
+	NumDropped() int64
+	Close()
+}
+
+type memoryDupeFilter struct {
+	mu           sync.Mutex
+	fingerprints map[string]struct{}
+	dropped      int64
+	// 记录新指纹, 用于持久化
+	record func(fp string)
+
+	logger *logrus.Entry
+}
+
+var _ DupeFilter = (*memoryDupeFilter)(nil)
+
+func (df *memoryDupeFilter) RequestSeen(req *gen.Request) bool {
+	fp, err := Fingerprint(req)
+	if err != nil {
+		// 无法计算指纹时不进行过滤, 请求出错会交给 ErrBack 处理
+		df.logger.WithField("Error", err).Warnln("Can not get request fingerprint")
+		return false
+	}
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if _, ok := df.fingerprints[fp]; ok {
+		atomic.AddInt64(&df.dropped, 1)
+		return true
+	}
+	df.fingerprints[fp] = struct{}{}
+	if df.record != nil {
+		df.record(fp)
+	}
+	return false
+}
+func (df *memoryDupeFilter) NumDropped() int64 {
+	return atomic.LoadInt64(&df.dropped)
+}
+func (df *memoryDupeFilter) Close() {
+	df.logger.WithField("NumDropped", df.NumDropped()).Infoln("DupeFilter closed")
+}
+
+// 在内存中记录请求指纹的过滤器, 程序结束后记录就会丢失
+func NewMemoryDupeFilter() DupeFilter {
+	df := new(memoryDupeFilter)
+	df.fingerprints = make(map[string]struct{})
+	df.logger = Logger.WithField("DupeFilter", fmt.Sprintf("%p", df))
+	return df
+}
+
+// 持久化的指纹文件名
+const seenFile = "requests.seen"
+
+type diskDupeFilter struct {
+	*memoryDupeFilter
+	file *os.File
+}
+
+func (df *diskDupeFilter) Close() {
+	if err := df.file.Close(); err != nil {
+		df.logger.Errorln(err)
+	}
+	df.memoryDupeFilter.Close()
+}
+
+// 将请求指纹持久化到 dir 目录下的过滤器, 使用同一目录的过滤器会载入之前记录的指纹
+func NewDiskDupeFilter(dir string) (DupeFilter, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path.Join(dir, seenFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	df := &diskDupeFilter{NewMemoryDupeFilter().(*memoryDupeFilter), file}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if fp := scanner.Text(); fp != "" {
+			df.fingerprints[fp] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	df.record = func(fp string) {
+		if _, err := file.WriteString(fp + "\n"); err != nil {
+			df.logger.Errorln(err)
+		}
+	}
+	df.logger.WithFields(logrus.Fields{"Dir": dir, "NumFingerprint": len(df.fingerprints)}).Infoln("DupeFilter loaded")
+	return df, nil
+}
+
+// 请求是否需要进行过滤
+func dontFilter(req *gen.Request) bool {
+	return MetaOf(req).DontFilter
+}
+
+type dupeFilterScheduler struct {
+	RequestScheduler
+	df DupeFilter
+}
+
+func (rs *dupeFilterScheduler) Put(reqs ...*gen.Request) {
+	filtered := make([]*gen.Request, 0, len(reqs))
+	for _, req := range reqs {
+		if req == nil || dontFilter(req) || !rs.df.RequestSeen(req) {
+			filtered = append(filtered, req)
+		}
+	}
+	rs.RequestScheduler.Put(filtered...)
+}
+func (rs *dupeFilterScheduler) Unwrap() RequestScheduler {
+	return rs.RequestScheduler
+}
+func (rs *dupeFilterScheduler) Dispose() {
+	rs.RequestScheduler.Dispose()
+	rs.df.Close()
+}
+
+// 为请求调度器添加请求去重功能, 重复的请求不会入队, 调度器释放时关闭过滤器并输出过滤掉的请求数量
+func NewDupeFilterScheduler(rs RequestScheduler, df DupeFilter) RequestScheduler {
+	return &dupeFilterScheduler{rs, df}
+}
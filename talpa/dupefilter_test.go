@@ -0,0 +1,64 @@
+package talpa
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+func newPostRequest(url, body string) *gen.Request {
+	return gen.NewRequest().Method("POST").URL(url).BodyString(body)
+}
+
+func TestDupeFilterScheduler(t *testing.T) {
+	df := NewMemoryDupeFilter()
+	rs := NewDupeFilterScheduler(NewRequestScheduler(10), df)
+	dontFilter := newPostRequest("http://www.example.com/", "a=1")
+	dontFilter.Context.Set("DontFilter", true)
+	rs.Put(
+		newPostRequest("http://www.example.com/", "a=1"),
+		newPostRequest("http://www.example.com/", "a=1"),
+		newPostRequest("http://www.example.com/", "a=2"),
+		newPostRequest("http://www.example.com/?b=1", "a=1"),
+		dontFilter,
+	)
+	rs.Put(newPostRequest("http://www.example.com/", "a=2"))
+	if rs.Len() != 4 {
+		t.Errorf("%d requests were queued, 4 expected", rs.Len())
+	}
+	if df.NumDropped() != 2 {
+		t.Errorf("%d requests were dropped, 2 expected", df.NumDropped())
+	}
+	rs.Dispose()
+}
+
+func TestDiskDupeFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	df, err := NewDiskDupeFilter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if df.RequestSeen(newPostRequest("http://www.example.com/", "a=1")) {
+		t.Error("Request was seen in an empty DupeFilter")
+	}
+	df.Close()
+
+	df, err = NewDiskDupeFilter(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer df.Close()
+	if !df.RequestSeen(newPostRequest("http://www.example.com/", "a=1")) {
+		t.Error("Request was not seen after DupeFilter reloaded")
+	}
+	if df.RequestSeen(newPostRequest("http://www.example.com/", "a=2")) {
+		t.Error("Different request was seen")
+	}
+}
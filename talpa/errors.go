@@ -0,0 +1,104 @@
+package talpa
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/debug"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// 汇总中最多保留的错误数量, 超过时只计数不保存
+const maxSummaryErrors = 100
+
+// 爬虫运行结束时的错误汇总
+type ErrorSummary struct {
+	// 导致爬虫提前结束的原因, 如 context.Canceled, 正常结束时为 nil
+	Cause error
+	// 运行过程中出现的错误总数
+	NumErrors int
+	// 最先出现的部分错误, 最多保留 maxSummaryErrors 个
+	Errors []error
+	// 爬虫结束时仍在调度器中没有被发送的请求数量
+	NumUnscheduled int64
+}
+
+func (s *ErrorSummary) Error() string {
+	var buf bytes.Buffer
+	buf.WriteString("talpa: ")
+	if s.Cause != nil {
+		fmt.Fprintf(&buf, "crawler stopped by %s, ", s.Cause)
+	}
+	fmt.Fprintf(&buf, "%d errors, %d requests unscheduled", s.NumErrors, s.NumUnscheduled)
+	for _, err := range s.Errors {
+		buf.WriteString("\n\t")
+		buf.WriteString(err.Error())
+	}
+	if s.NumErrors > len(s.Errors) {
+		fmt.Fprintf(&buf, "\n\t... and %d more", s.NumErrors-len(s.Errors))
+	}
+	return buf.String()
+}
+
+// 并发安全的错误记录
+type errorRecorder struct {
+	mu     sync.Mutex
+	num    int
+	errors []error
+}
+
+func (r *errorRecorder) Record(err error) {
+	if err == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.num++
+	if len(r.errors) < maxSummaryErrors {
+		r.errors = append(r.errors, err)
+	}
+}
+
+// 已经记录的错误数量
+func (r *errorRecorder) Num() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.num
+}
+
+// 生成错误汇总, 没有任何错误时返回 nil
+func (r *errorRecorder) Summary(cause error, unscheduled int64) *ErrorSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cause == nil && r.num == 0 && unscheduled == 0 {
+		return nil
+	}
+	errs := make([]error, len(r.errors))
+	copy(errs, r.errors)
+	return &ErrorSummary{
+		Cause:          cause,
+		NumErrors:      r.num,
+		Errors:         errs,
+		NumUnscheduled: unscheduled,
+	}
+}
+
+// 回调或任务中出现的 panic
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// 需要在 recover 的 defer 函数中调用才能得到 panic 时的调用栈
+func newPanicError(v interface{}) *PanicError {
+	return &PanicError{Value: v, Stack: debug.Stack()}
+}
+
+func (e *PanicError) Error() string {
+	// logrus 的 Panicln 等方法 panic 时的值为日志条目, 只使用其中的消息
+	if entry, ok := e.Value.(*logrus.Entry); ok {
+		return "talpa: panic: " + entry.Message
+	}
+	return fmt.Sprintf("talpa: panic: %v", e.Value)
+}
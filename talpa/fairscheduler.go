@@ -0,0 +1,199 @@
+package talpa
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Workiva/go-datastructures/queue"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 可选的爬虫接口, 多个爬虫共用一个 Crawler 时用于公平调度
+type FairSpider interface {
+	Spider
+	// 从 SpiderScheduler 中取出请求的权重, 小于 1 时当作 1
+	Weight() int
+	// 爬虫同时在途的请求数量上限, 0 表示只受下载器并发的限制
+	Concurrency() int
+}
+
+// 可选的爬虫接口, 同一个爬虫两次分发请求之间的最小间隔, 与下载器按主机的请求间隔同时生效.
+// 间隔在 Crawler 分发请求时控制, 不会占用下载器的并发, 需要使用 SpiderScheduler
+type DelayedSpider interface {
+	Spider
+	DownloadDelay() time.Duration
+}
+
+// 按爬虫分别排队的请求调度器, Crawler 使用它实现每个爬虫的并发配额和完成状态
+type SpiderScheduler interface {
+	RequestScheduler
+	// 按公平的顺序从 allow 返回 true 的爬虫的队列中取出一个请求, 没有可取的请求时返回 nil, allow 为 nil 时允许所有爬虫
+	GetFrom(allow func(Spider) bool) *gen.Request
+	// 爬虫队列中的请求数量
+	LenOf(s Spider) int64
+}
+
+// 包装了其他调度器的调度器, 如 NewDupeFilterScheduler 返回的调度器
+type wrappedScheduler interface {
+	Unwrap() RequestScheduler
+}
+
+// 找到调度器本身或者被包装的 SpiderScheduler, 取出请求时不需要经过包装的调度器
+func spiderSchedulerOf(rs RequestScheduler) (SpiderScheduler, bool) {
+	for {
+		if ss, ok := rs.(SpiderScheduler); ok {
+			return ss, true
+		}
+		w, ok := rs.(wrappedScheduler)
+		if !ok {
+			return nil, false
+		}
+		rs = w.Unwrap()
+	}
+}
+
+// 单个爬虫的优先队列, current 用于平滑加权轮询
+type spiderQueue struct {
+	spider  Spider
+	pq      *queue.PriorityQueue
+	weight  int
+	current int
+}
+
+type fairRequestScheduler struct {
+	mu     sync.Mutex
+	queues map[Spider]*spiderQueue
+	// 按创建顺序保存队列, 使轮询的顺序固定
+	order    []*spiderQueue
+	hint     int
+	len      int64
+	disposed bool
+	counter  *queueCounter
+
+	logger *logrus.Entry
+}
+
+var (
+	_ SpiderScheduler     = (*fairRequestScheduler)(nil)
+	_ SummarizedScheduler = (*fairRequestScheduler)(nil)
+)
+
+func (rs *fairRequestScheduler) queueOf(s Spider) *spiderQueue {
+	q, ok := rs.queues[s]
+	if !ok {
+		q = &spiderQueue{spider: s, pq: queue.NewPriorityQueue(rs.hint, false), weight: 1}
+		if fs, ok := s.(FairSpider); ok && fs.Weight() > 1 {
+			q.weight = fs.Weight()
+		}
+		rs.queues[s] = q
+		rs.order = append(rs.order, q)
+	}
+	return q
+}
+
+func (rs *fairRequestScheduler) Dispose() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, q := range rs.order {
+		q.pq.Dispose()
+	}
+	rs.disposed = true
+	rs.logger.WithField("NumSpider", len(rs.order)).Infoln("RequestScheduler disposed")
+}
+func (rs *fairRequestScheduler) Disposed() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.disposed
+}
+func (rs *fairRequestScheduler) Len() int64 {
+	return atomic.LoadInt64(&rs.len)
+}
+func (rs *fairRequestScheduler) Empty() bool {
+	return rs.Len() == 0
+}
+func (rs *fairRequestScheduler) LenOf(s Spider) int64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if q, ok := rs.queues[s]; ok {
+		return int64(q.pq.Len())
+	}
+	return 0
+}
+
+// 请求按所属的爬虫放入对应的队列, 没有标记爬虫的请求放在同一个队列中
+func (rs *fairRequestScheduler) Put(reqs ...*gen.Request) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, req := range reqs {
+		if req == nil {
+			rs.logger.Panicln("Cann't push a nil request into queue!")
+		}
+		item := newRequestItem(req)
+		if err := rs.queueOf(spiderOf(req)).pq.Put(item); err != nil {
+			rs.logger.Panicln(err)
+		}
+		rs.counter.add(item.(*requestItem), 1)
+	}
+	atomic.AddInt64(&rs.len, int64(len(reqs)))
+}
+
+// 平滑加权轮询: 每次选择时所有可选队列的 current 增加各自的权重, 选出 current 最大的队列后减去权重总和
+func (rs *fairRequestScheduler) GetFrom(allow func(Spider) bool) *gen.Request {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var selected *spiderQueue
+	total := 0
+	for _, q := range rs.order {
+		if q.pq.Empty() || (allow != nil && !allow(q.spider)) {
+			continue
+		}
+		q.current += q.weight
+		total += q.weight
+		if selected == nil || q.current > selected.current {
+			selected = q
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+	selected.current -= total
+	items, err := selected.pq.Get(1)
+	if err != nil {
+		rs.logger.Panicln(err)
+	}
+	atomic.AddInt64(&rs.len, -1)
+	item := items[0].(*requestItem)
+	rs.counter.add(item, -1)
+	return item.Req
+}
+
+// 最多取出 number 个请求, 队列为空时不会阻塞
+func (rs *fairRequestScheduler) Get(number int64) []*gen.Request {
+	reqs := make([]*gen.Request, 0, number)
+	for int64(len(reqs)) < number {
+		req := rs.GetFrom(nil)
+		if req == nil {
+			break
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+func (rs *fairRequestScheduler) Summary() []QueueSummary {
+	return rs.counter.summary()
+}
+
+// 按爬虫分别排队的公平请求调度器, 每个爬虫的队列仍按优先级排序,
+// 爬虫之间按 FairSpider 的权重轮询, 没有实现 FairSpider 的爬虫权重为 1
+func NewFairRequestScheduler(hint int64) RequestScheduler {
+	rs := new(fairRequestScheduler)
+	rs.hint = int(hint)
+	rs.queues = make(map[Spider]*spiderQueue)
+	rs.counter = newQueueCounter()
+	rs.logger = Logger.WithField("RequestScheduler", fmt.Sprintf("%p", rs))
+	return rs
+}
@@ -0,0 +1,161 @@
+package talpa
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 请求地址以爬虫名称开头的爬虫, 用于区分不同爬虫的请求
+type fairSpider struct {
+	name        string
+	url         string
+	num         int
+	weight      int
+	concurrency int
+	delay       time.Duration
+}
+
+func (s *fairSpider) Name() string {
+	return s.name
+}
+func (s *fairSpider) Weight() int {
+	return s.weight
+}
+func (s *fairSpider) Concurrency() int {
+	return s.concurrency
+}
+func (s *fairSpider) DownloadDelay() time.Duration {
+	return s.delay
+}
+func (s *fairSpider) StartRequests() []*gen.Request {
+	reqs := make([]*gen.Request, s.num)
+	for i := range reqs {
+		reqs[i] = gen.NewRequest().URL(s.url + "/" + s.name)
+		MetaOf(reqs[i]).CallBack = s.Parse
+		markSpider(s, reqs[i:i+1])
+	}
+	return reqs
+}
+func (s *fairSpider) Parse(res *gen.Response, h Helper) {}
+
+func TestFairRequestScheduler(t *testing.T) {
+	a := &fairSpider{name: "a", num: 6, weight: 2}
+	b := &fairSpider{name: "b", num: 6}
+	rs := NewFairRequestScheduler(10)
+	rs.Put(a.StartRequests()...)
+	rs.Put(b.StartRequests()...)
+	ss, ok := spiderSchedulerOf(NewDupeFilterScheduler(rs, NewMemoryDupeFilter()))
+	if !ok {
+		t.Fatal("SpiderScheduler was not found")
+	}
+	if ss.Len() != 12 || ss.LenOf(a) != 6 || ss.LenOf(b) != 6 {
+		t.Fatalf("Len=%d LenOf(a)=%d LenOf(b)=%d", ss.Len(), ss.LenOf(a), ss.LenOf(b))
+	}
+
+	// 权重为 2:1 时按 a, b, a 的顺序轮询
+	var order []string
+	for _, req := range ss.Get(6) {
+		order = append(order, SpiderName(spiderOf(req)))
+	}
+	if s := strings.Join(order, ""); s != "abaaba" {
+		t.Errorf("Order is %s, abaaba expected", s)
+	}
+	// 跳过不允许的爬虫
+	onlyB := func(s Spider) bool { return s == b }
+	for i := 0; i < 4; i++ {
+		req := ss.GetFrom(onlyB)
+		if req == nil || spiderOf(req) != b {
+			t.Fatalf("Request of b expected, got %v", req)
+		}
+	}
+	if req := ss.GetFrom(onlyB); req != nil {
+		t.Errorf("Queue of b is not empty")
+	}
+	if n := len(ss.Get(10)); n != 2 || !ss.Empty() {
+		t.Errorf("Get %d requests, 2 expected, Len=%d", n, ss.Len())
+	}
+	rs.Dispose()
+	if !rs.Disposed() {
+		t.Error("Scheduler was not disposed")
+	}
+}
+
+func TestCrawlerSpiderQuota(t *testing.T) {
+	var mu sync.Mutex
+	current := make(map[string]int)
+	max := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current[r.URL.Path]++
+		if current[r.URL.Path] > max[r.URL.Path] {
+			max[r.URL.Path] = current[r.URL.Path]
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		current[r.URL.Path]--
+		mu.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	a := &fairSpider{name: "a", url: ts.URL, num: 10, concurrency: 1}
+	b := &fairSpider{name: "b", url: ts.URL, num: 10, concurrency: 2}
+	crawler := NewCrawler([]Spider{a, b}, NewFairRequestScheduler(10), NewDownloader(6), nil, nil)
+	var closed []Spider
+	crawler.Connect(SpiderClosed, func(e *Event) {
+		mu.Lock()
+		closed = append(closed, e.Spider)
+		mu.Unlock()
+	})
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if max["/a"] != 1 || max["/b"] > 2 {
+		t.Errorf("Max concurrency a=%d b=%d, exceeds quota", max["/a"], max["/b"])
+	}
+	if len(closed) != 2 {
+		t.Errorf("SpiderClosed was sent %d times, 2 expected", len(closed))
+	}
+	for _, status := range crawler.SpiderStatus() {
+		if status.Sent != 10 || status.Queued != 0 || status.Inflight != 0 || !status.Closed {
+			t.Errorf("Unexpected status %+v", status)
+		}
+	}
+}
+
+func TestCrawlerSpiderDelay(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	delay := 20 * time.Millisecond
+	a := &fairSpider{name: "a", url: ts.URL, num: 4, delay: delay}
+	crawler := NewCrawler([]Spider{a}, NewFairRequestScheduler(10), NewDownloader(4), nil, nil)
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != a.num {
+		t.Fatalf("%d requests were sent, %d expected", len(times), a.num)
+	}
+	// 允许请求到达服务器的时间有少量的误差
+	for i := 1; i < len(times); i++ {
+		if d := times[i].Sub(times[i-1]); d < delay-5*time.Millisecond {
+			t.Errorf("Interval %d is %v, at least %v expected", i, d, delay)
+		}
+	}
+}
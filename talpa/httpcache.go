@@ -0,0 +1,127 @@
+package talpa
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	thttp "github.com/go-tgod/tgod/http"
+	gen "gopkg.in/h2non/gentleman.v2"
+	genc "gopkg.in/h2non/gentleman.v2/context"
+	genp "gopkg.in/h2non/gentleman.v2/plugin"
+)
+
+// HTTP 缓存策略, 缓存按请求指纹保存在目录中, 与 thttp.RequestDumper 和 thttp.ResponseDumper 的目录结构相同,
+// 可以直接使用它们保存的响应
+type HTTPCachePolicy struct {
+	// 缓存目录, 为空时使用 thttp.DefaultDumpDir
+	Dir string
+	// 缓存的有效期, 从响应的 Date 头部开始计算, 没有 Date 头部时从保存的时间开始计算, 为 0 表示永不过期
+	Expiration time.Duration
+	// 这些状态码的响应不会写入缓存, 已经缓存的也不会使用
+	IgnoreStatus []int
+	// 总是发送请求并用新的响应更新缓存, 不读取缓存
+	RefreshOnly bool
+	// 判断响应是否可以写入缓存, 比如接口在响应体中返回的错误不应该缓存, 为 nil 时缓存所有没有忽略状态码的响应
+	Cacheable func(res *gen.Response) bool
+}
+
+// 来自缓存的响应在请求的 Context 中的标记
+type httpCacheKey struct{}
+
+// 响应是否来自 HTTP 缓存
+func FromHTTPCache(res *gen.Response) bool {
+	cached, _ := res.Context.Get(httpCacheKey{}).(bool)
+	return cached
+}
+
+type httpCacheMiddleware struct {
+	BaseDownloaderMiddleware
+	policy HTTPCachePolicy
+	ignore map[int]bool
+
+	logger *logrus.Entry
+}
+
+var _ DownloaderMiddleware = (*httpCacheMiddleware)(nil)
+
+// 缓存是否过期
+func (m *httpCacheMiddleware) expired(fp string, res *http.Response) bool {
+	if m.policy.Expiration <= 0 {
+		return false
+	}
+	saved, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		info, err := os.Stat(path.Join(thttp.DumpDir(m.policy.Dir, fp), thttp.ResponseHeaderFile))
+		if err != nil {
+			return true
+		}
+		saved = info.ModTime()
+	}
+	return time.Since(saved) > m.policy.Expiration
+}
+
+// 命中缓存时在 "before dial" 阶段注入缓存的响应, gentleman 不会再发送请求, 但会正常执行响应阶段的插件
+func (m *httpCacheMiddleware) ProcessRequest(req *gen.Request) (*gen.Response, error) {
+	if m.policy.RefreshOnly {
+		return nil, nil
+	}
+	raw, fp, err := rawFingerprint(req)
+	if err != nil {
+		// 请求本身有错误, 发送时会交给 ErrBack 处理
+		return nil, nil
+	}
+	cached, err := thttp.LoadResponse(m.policy.Dir, fp, raw)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			m.logger.WithFields(logrus.Fields{"FingerPrint": fp, "Error": err}).Warnln("Cache was broken")
+		}
+		return nil, nil
+	}
+	if m.ignore[cached.StatusCode] || m.expired(fp, cached) {
+		return nil, nil
+	}
+	req.Use(genp.NewPhasePlugin("before dial", func(ctx *genc.Context, h genc.Handler) {
+		cached.Request = ctx.Request
+		ctx.Response = cached
+		h.Next(ctx)
+	}))
+	req.Context.Set(httpCacheKey{}, true)
+	m.logger.WithField("FingerPrint", fp).Debugln("Cache hit")
+	return req.Do()
+}
+
+// 保存没有来自缓存的响应, 响应体可能已经被之前的中间件读取, 使用 Bytes 读取响应体不会影响回调解析响应
+func (m *httpCacheMiddleware) ProcessResponse(req *gen.Request, res *gen.Response) (*gen.Response, error) {
+	if FromHTTPCache(res) || res.RawResponse == nil || m.ignore[res.StatusCode] {
+		return res, nil
+	}
+	if m.policy.Cacheable != nil && !m.policy.Cacheable(res) {
+		m.logger.WithField("URL", req.Context.Request.URL.String()).Debugln("Response was not cacheable")
+		return res, nil
+	}
+	raw, fp, err := rawFingerprint(req)
+	if err == nil {
+		err = thttp.SaveRequest(m.policy.Dir, fp, raw, true)
+	}
+	if err == nil {
+		err = thttp.SaveResponseBytes(m.policy.Dir, fp, res.RawResponse, res.Bytes())
+	}
+	if err != nil {
+		// 缓存失败不影响请求的处理
+		m.logger.WithFields(logrus.Fields{"FingerPrint": fp, "Error": err}).Warnln("Response was not cached")
+	}
+	return res, nil
+}
+
+// 根据缓存策略读取和保存响应的下载器中间件, 需要放在重试等中间件之前, 命中缓存的请求不会经过之后的中间件发送
+func NewHTTPCacheMiddleware(policy HTTPCachePolicy) DownloaderMiddleware {
+	m := &httpCacheMiddleware{policy: policy, ignore: make(map[int]bool, len(policy.IgnoreStatus))}
+	for _, status := range policy.IgnoreStatus {
+		m.ignore[status] = true
+	}
+	m.logger = Logger.WithField("HTTPCache", thttp.DumpDir(policy.Dir, ""))
+	return m
+}
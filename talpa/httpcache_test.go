@@ -0,0 +1,77 @@
+package talpa
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+func TestHTTPCacheMiddleware(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/error" {
+			w.Write([]byte(`{"error_code":"1"}`))
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer ts.Close()
+	dir, err := ioutil.TempDir("", "talpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fetch := func(policy HTTPCachePolicy, path string) (*gen.Response, bool) {
+		req := gen.NewRequest().URL(ts.URL + path)
+		ms := downloaderMiddlewares{NewHTTPCacheMiddleware(policy)}
+		res, err := ms.process(req, func(req *gen.Request) (*gen.Response, error) { return req.Do() })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, FromHTTPCache(res)
+	}
+	policy := HTTPCachePolicy{Dir: dir, IgnoreStatus: []int{http.StatusNotFound}, Cacheable: func(res *gen.Response) bool {
+		return !strings.Contains(res.String(), "error_code")
+	}}
+	for i, tt := range []struct {
+		policy HTTPCachePolicy
+		path   string
+		cached bool
+		hits   int32
+	}{
+		{policy, "/a", false, 1},
+		{policy, "/a", true, 1},
+		// 忽略的状态码不会被缓存
+		{policy, "/missing", false, 2},
+		{policy, "/missing", false, 3},
+		// 只更新缓存时总是发送请求
+		{HTTPCachePolicy{Dir: dir, RefreshOnly: true}, "/a", false, 4},
+		{policy, "/a", true, 4},
+		// 缓存过期后重新发送请求
+		{HTTPCachePolicy{Dir: dir, Expiration: time.Nanosecond}, "/a", false, 5},
+		// Cacheable 返回 false 的响应不会被缓存
+		{policy, "/error", false, 6},
+		{policy, "/error", false, 7},
+	} {
+		res, cached := fetch(tt.policy, tt.path)
+		if cached != tt.cached || atomic.LoadInt32(&hits) != tt.hits {
+			t.Errorf("Case %d: cached=%v hits=%d, %v and %d expected", i, cached, hits, tt.cached, tt.hits)
+		}
+		if res.StatusCode == http.StatusOK && tt.path != "/error" && res.String() != tt.path {
+			t.Errorf("Case %d: body is %q, %q expected", i, res.String(), tt.path)
+		}
+	}
+}
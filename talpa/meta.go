@@ -0,0 +1,121 @@
+package talpa
+
+import (
+	"errors"
+	"fmt"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+	genc "gopkg.in/h2non/gentleman.v2/context"
+)
+
+// 请求的元数据, 保存在请求的 Context 中, 通过 MetaOf 得到并直接修改
+type RequestMeta struct {
+	// 解析响应的回调函数, 必须设置
+	CallBack func(*gen.Response, Helper)
+	// 请求出错或者 CallBack 中出现 panic 时调用, 为空时交给 Crawler 的错误处理函数
+	ErrBack func(*gen.Response)
+	// 优先级, 越大越先发送
+	Priority int
+	// 请求的深度, 初始请求为 0, 回调产生的请求为原请求的深度加 1
+	Depth int
+	// 请求所属的爬虫, 由 Crawler 在请求入队时设置
+	Spider Spider
+	// 请求已经重试的次数
+	RetryTimes int
+	// 为 true 时请求不会被 DupeFilter 过滤
+	DontFilter bool
+	// 自定义的数据
+	Meta map[string]interface{}
+
+	// 请求是否已经通过 Helper 入队过, 重试和恢复的请求不会重新计算深度
+	scheduled bool
+}
+
+type metaKey struct{}
+
+// 旧的 Context 键, 设置了这些键的请求在第一次读取元数据时转换为 RequestMeta
+var legacyMetaKeys = []string{"CallBack", "ErrBack", "Priority", "Spider", "RetryTimes", "DontFilter"}
+
+// 得到请求的元数据, 没有时创建一个新的元数据
+func MetaOf(req *gen.Request) *RequestMeta {
+	m, _ := metaFromContext(req.Context)
+	return m
+}
+
+// 得到响应对应的请求的元数据, 用于在回调中读取请求的深度, 自定义数据等
+func ResponseMeta(res *gen.Response) *RequestMeta {
+	m, _ := metaFromContext(res.Context)
+	return m
+}
+
+// 得到 Context 中的元数据, 同时返回转换旧的 Context 键时出现的错误
+func metaFromContext(ctx *genc.Context) (*RequestMeta, error) {
+	if m, ok := ctx.Get(metaKey{}).(*RequestMeta); ok {
+		return m, nil
+	}
+	m := new(RequestMeta)
+	err := m.migrate(ctx)
+	ctx.Set(metaKey{}, m)
+	return m, err
+}
+
+// 转换使用字符串键设置在 Context 中的元数据, 类型不正确的值会被忽略并返回错误
+func (m *RequestMeta) migrate(ctx *genc.Context) error {
+	for _, key := range legacyMetaKeys {
+		v, ok := ctx.GetOk(key)
+		if !ok || v == nil {
+			continue
+		}
+		switch key {
+		case "CallBack":
+			m.CallBack, ok = v.(func(*gen.Response, Helper))
+		case "ErrBack":
+			m.ErrBack, ok = v.(func(*gen.Response))
+		case "Priority":
+			m.Priority, ok = v.(int)
+		case "Spider":
+			m.Spider, ok = v.(Spider)
+		case "RetryTimes":
+			m.RetryTimes, ok = v.(int)
+		case "DontFilter":
+			m.DontFilter, ok = v.(bool)
+		}
+		if !ok {
+			return fmt.Errorf("%q has type %T", key, v)
+		}
+	}
+	return nil
+}
+
+// 复制元数据, 自定义数据只做浅复制
+func (m *RequestMeta) clone() *RequestMeta {
+	c := *m
+	if m.Meta != nil {
+		c.Meta = make(map[string]interface{}, len(m.Meta))
+		for k, v := range m.Meta {
+			c.Meta[k] = v
+		}
+	}
+	return &c
+}
+
+var errNilRequest = errors.New("talpa: nil request")
+
+// 检查请求的元数据, 请求入队时调用, 使错误在产生请求的地方就被发现
+func ValidateRequest(req *gen.Request) error {
+	if req == nil {
+		return errNilRequest
+	}
+	m, err := metaFromContext(req.Context)
+	if err == nil && m.CallBack == nil {
+		err = errors.New("CallBack is not set")
+	}
+	if err != nil {
+		url := "?"
+		if raw, rerr := RawRequest(req); rerr == nil {
+			url = raw.URL.String()
+		}
+		return fmt.Errorf("talpa: invalid request %s: %s", url, err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package talpa
+
+import (
+	"strings"
+	"testing"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+func TestRequestMetaMigrate(t *testing.T) {
+	req := gen.NewRequest()
+	req.Context.Set("CallBack", func(*gen.Response, Helper) {})
+	req.Context.Set("Priority", 2)
+	req.Context.Set("DontFilter", true)
+	if err := ValidateRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	meta := MetaOf(req)
+	if meta.CallBack == nil || meta.Priority != 2 || !meta.DontFilter {
+		t.Errorf("Legacy keys were not migrated: %+v", meta)
+	}
+
+	clone := cloneRequest(req)
+	MetaOf(clone).Priority = 3
+	if meta.Priority != 2 {
+		t.Error("Meta was shared by the clone")
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	if err := ValidateRequest(nil); err == nil {
+		t.Error("Nil request was valid")
+	}
+	req := gen.NewRequest().URL("http://www.example.com/")
+	if err := ValidateRequest(req); err == nil || !strings.Contains(err.Error(), "http://www.example.com/") {
+		t.Errorf("Request without CallBack returns %v", err)
+	}
+	req = gen.NewRequest()
+	req.Context.Set("CallBack", func(*gen.Response) {})
+	if err := ValidateRequest(req); err == nil || !strings.Contains(err.Error(), "CallBack") {
+		t.Errorf("Request with wrong CallBack type returns %v", err)
+	}
+}
+
+func TestResponseMeta(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	req := gen.NewRequest().URL(ts.URL)
+	MetaOf(req).Depth = 2
+	res, err := req.Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta := ResponseMeta(res); meta.Depth != 2 {
+		t.Errorf("Depth in response meta is %d, 2 expected", meta.Depth)
+	}
+}
@@ -0,0 +1,154 @@
+package talpa
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// 指标类型
+const (
+	MetricCounter = "counter"
+	MetricGauge   = "gauge"
+)
+
+// 单个 Prometheus 指标样本, 同名的样本需要有相同的 Help 和 Type
+type Metric struct {
+	Name   string
+	Help   string
+	Type   string
+	Labels map[string]string
+	Value  float64
+}
+
+// 可选的指标接口, 实现了这个接口的爬虫会在导出指标时被调用
+type MetricsCollector interface {
+	CollectMetrics() []Metric
+}
+
+// 收集 Crawler 和爬虫的指标
+func (c *Crawler) metrics() []Metric {
+	gauge := func(name, help string, v int64) Metric {
+		return Metric{Name: name, Help: help, Type: MetricGauge, Value: float64(v)}
+	}
+	counter := func(name, help string, v int64) Metric {
+		return Metric{Name: name, Help: help, Type: MetricCounter, Value: float64(v)}
+	}
+	stats := c.Stats()
+	ms := []Metric{
+		gauge("talpa_request_queue_length", "Number of requests in the request scheduler.", c.requestScheduler.Len()),
+		gauge("talpa_downloader_waiting_jobs", "Number of requests waiting in the downloader.", int64(c.downloader.NumWaitingJobs())),
+		gauge("talpa_downloader_workers", "Number of downloader workers.", int64(c.downloader.NumWorkers())),
+		gauge("talpa_inflight_requests", "Number of requests dispatched but not finished.", c.numInflightRequests()),
+		gauge("talpa_crawler_paused", "Whether the crawler is paused (1) or not (0).", int64(atomic.LoadInt32(&c.paused))),
+		counter("talpa_requests_scheduled_total", "Total number of scheduled requests.", stats.Counters[StatsRequestScheduled]),
+		counter("talpa_requests_sent_total", "Total number of requests sent to the downloader.", stats.Counters[StatsRequestSent]),
+		counter("talpa_requests_failed_total", "Total number of failed requests.", stats.Counters[StatsRequestFailed]),
+		counter("talpa_response_bytes_total", "Total bytes of response bodies.", stats.Counters[StatsResponseBytes]),
+		counter("talpa_errors_total", "Total number of errors recorded by the crawler.", int64(c.errs.Num())),
+	}
+	if c.scraper != nil {
+		ms = append(ms,
+			gauge("talpa_job_queue_length", "Number of jobs in the job scheduler.", c.jobScheduler.Len()),
+			gauge("talpa_scraper_waiting_jobs", "Number of jobs waiting in the scraper.", int64(c.scraper.NumWaitingJobs())),
+			gauge("talpa_scraper_workers", "Number of scraper workers.", int64(c.scraper.NumWorkers())),
+		)
+	}
+	statusPrefix, itemPrefix := "response/status/", StatsItemScraped+"/"
+	for key, v := range stats.Counters {
+		switch {
+		case strings.HasPrefix(key, statusPrefix):
+			m := counter("talpa_responses_total", "Total number of responses by HTTP status.", v)
+			m.Labels = map[string]string{"status": strings.TrimPrefix(key, statusPrefix)}
+			ms = append(ms, m)
+		case strings.HasPrefix(key, itemPrefix):
+			m := counter("talpa_items_scraped_total", "Total number of scraped items by type.", v)
+			m.Labels = map[string]string{"type": strings.TrimPrefix(key, itemPrefix)}
+			ms = append(ms, m)
+		}
+	}
+	for _, s := range c.spiders {
+		if mc, ok := s.(MetricsCollector); ok {
+			ms = append(ms, mc.CollectMetrics()...)
+		}
+	}
+	return ms
+}
+
+// 以 Prometheus 文本格式输出 Crawler 的指标
+func (c *Crawler) WriteMetrics(w io.Writer) error {
+	return writeMetrics(w, c.metrics())
+}
+
+// 用于 Prometheus 抓取的 http.Handler
+func (c *Crawler) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := c.WriteMetrics(w); err != nil {
+			c.logger.WithField("Error", err).Warnln("Failed to write metrics")
+		}
+	})
+}
+
+// 在 addr 上启动指标监听, 路径为 /metrics, 返回的 http.Server 由调用者关闭.
+// addr 的端口为 0 时会随机选择端口, 实际监听的地址保存在 http.Server 的 Addr 中
+func (c *Crawler) ServeMetrics(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.MetricsHandler())
+	srv := &http.Server{Addr: ln.Addr().String(), Handler: mux}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			c.logger.WithField("Error", err).Errorln("Metrics server stopped")
+		}
+	}()
+	c.logger.WithField("Addr", srv.Addr).Infoln("Metrics server started")
+	return srv, nil
+}
+
+// 同名的样本放在一起, 每个指标只输出一次 HELP 和 TYPE
+func writeMetrics(w io.Writer, ms []Metric) error {
+	sort.SliceStable(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+	bw := bufio.NewWriter(w)
+	for i, m := range ms {
+		if i == 0 || ms[i-1].Name != m.Name {
+			fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type)
+		}
+		bw.WriteString(m.Name)
+		writeLabels(bw, m.Labels)
+		bw.WriteByte(' ')
+		bw.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLabels(w *bufio.Writer, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		fmt.Fprintf(w, `%s="%s"`, name, labelEscaper.Replace(labels[name]))
+	}
+	w.WriteByte('}')
+}
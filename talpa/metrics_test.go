@@ -0,0 +1,61 @@
+package talpa
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type metricsSpider struct {
+	itemSpider
+}
+
+func (s *metricsSpider) CollectMetrics() []Metric {
+	return []Metric{
+		{Name: "test_spider_info", Help: "Test spider.", Type: MetricGauge, Labels: map[string]string{"name": `a"b`}, Value: 1},
+	}
+}
+
+func TestCrawlerMetrics(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	spider := &metricsSpider{itemSpider{url: ts.URL, num: 3}}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	srv, err := crawler.ServeMetrics("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	crawler.Run(context.Background())
+
+	res, err := http.Get("http://" + srv.Addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+	for _, line := range []string{
+		"# TYPE talpa_requests_sent_total counter",
+		"talpa_requests_sent_total 3",
+		"talpa_request_queue_length 0",
+		"talpa_downloader_workers 2",
+		"talpa_scraper_workers 2",
+		`talpa_responses_total{status="200"} 3`,
+		`talpa_items_scraped_total{type="int"} 3`,
+		`test_spider_info{name="a\"b"} 1`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("Metrics does not contain %q:\n%s", line, text)
+		}
+	}
+	if strings.Count(text, "# TYPE talpa_responses_total") != 1 {
+		t.Errorf("TYPE of talpa_responses_total was written more than once:\n%s", text)
+	}
+}
@@ -0,0 +1,91 @@
+package talpa
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 下载器中间件, 用于在请求发送前后进行处理, 如缓存, 重试, 统计等.
+// ProcessRequest 按注册顺序调用, ProcessResponse 和 ProcessError 按注册的相反顺序调用.
+// 中间件可以返回 ErrDropRequest 丢弃请求, 或者返回 *RescheduleError 将请求重新入队
+type DownloaderMiddleware interface {
+	// 请求发送前调用, 返回非 nil 的响应时不再发送请求, 直接使用该响应;
+	// 返回其他错误时请求视为发送失败
+	ProcessRequest(req *gen.Request) (*gen.Response, error)
+	// 请求发送成功后调用, 返回错误时请求视为发送失败
+	ProcessResponse(req *gen.Request, res *gen.Response) (*gen.Response, error)
+	// 请求发送失败后调用, 返回 nil 错误时请求视为发送成功, 之后的中间件将调用 ProcessResponse
+	ProcessError(req *gen.Request, res *gen.Response, err error) (*gen.Response, error)
+}
+
+// 不做任何处理的下载器中间件, 可以嵌入到其他中间件中只实现需要的方法
+type BaseDownloaderMiddleware struct{}
+
+func (BaseDownloaderMiddleware) ProcessRequest(req *gen.Request) (*gen.Response, error) {
+	return nil, nil
+}
+func (BaseDownloaderMiddleware) ProcessResponse(req *gen.Request, res *gen.Response) (*gen.Response, error) {
+	return res, nil
+}
+func (BaseDownloaderMiddleware) ProcessError(req *gen.Request, res *gen.Response, err error) (*gen.Response, error) {
+	return res, err
+}
+
+var _ DownloaderMiddleware = BaseDownloaderMiddleware{}
+
+// 中间件返回此错误时丢弃请求, 不会执行回调也不会记为错误
+var ErrDropRequest = errors.New("talpa: request dropped")
+
+// 中间件返回此错误时在等待 Delay 后将 Request 重新入队, Request 必须是没有发送过的请求
+type RescheduleError struct {
+	Request *gen.Request
+	Delay   time.Duration
+}
+
+func (e *RescheduleError) Error() string {
+	return fmt.Sprintf("talpa: request %p rescheduled after %s", e.Request, e.Delay)
+}
+
+// 是否是用于控制请求流程的错误, 这类错误不再交给后续的中间件处理
+func isControlError(err error) bool {
+	if err == ErrDropRequest {
+		return true
+	}
+	_, ok := err.(*RescheduleError)
+	return ok
+}
+
+type downloaderMiddlewares []DownloaderMiddleware
+
+// 依次调用中间件处理请求, send 用于实际发送请求
+func (ms downloaderMiddlewares) process(req *gen.Request, send func(*gen.Request) (*gen.Response, error)) (*gen.Response, error) {
+	var res *gen.Response
+	var err error
+	for _, m := range ms {
+		if res, err = m.ProcessRequest(req); res != nil || err != nil {
+			break
+		}
+	}
+	if res == nil && err == nil {
+		res, err = send(req)
+	}
+	for i := len(ms) - 1; i >= 0; i-- {
+		if isControlError(err) {
+			break
+		}
+		if err != nil {
+			res, err = ms[i].ProcessError(req, res, err)
+		} else {
+			res, err = ms[i].ProcessResponse(req, res)
+		}
+	}
+	return res, err
+}
+
+// 请求出错但没有响应时, 生成一个只包含错误信息的响应交给 ErrBack 处理
+func errorResponse(req *gen.Request, err error) *gen.Response {
+	return &gen.Response{Error: err, Context: req.Context}
+}
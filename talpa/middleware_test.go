@@ -0,0 +1,92 @@
+package talpa
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 记录中间件的调用顺序
+type recordMiddleware struct {
+	name    string
+	records *[]string
+}
+
+func (m recordMiddleware) ProcessRequest(req *gen.Request) (*gen.Response, error) {
+	*m.records = append(*m.records, m.name+".ProcessRequest")
+	return nil, nil
+}
+func (m recordMiddleware) ProcessResponse(req *gen.Request, res *gen.Response) (*gen.Response, error) {
+	*m.records = append(*m.records, m.name+".ProcessResponse")
+	return res, nil
+}
+func (m recordMiddleware) ProcessError(req *gen.Request, res *gen.Response, err error) (*gen.Response, error) {
+	*m.records = append(*m.records, m.name+".ProcessError")
+	// 从错误中恢复
+	return &gen.Response{Context: req.Context}, nil
+}
+
+func TestDownloaderMiddlewaresOrder(t *testing.T) {
+	var records []string
+	ms := downloaderMiddlewares{recordMiddleware{"a", &records}, recordMiddleware{"b", &records}, recordMiddleware{"c", &records}}
+	req := gen.NewRequest()
+	_, err := ms.process(req, func(*gen.Request) (*gen.Response, error) {
+		return nil, errors.New("test")
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []string{
+		"a.ProcessRequest", "b.ProcessRequest", "c.ProcessRequest",
+		"c.ProcessError", "b.ProcessResponse", "a.ProcessResponse",
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("Middlewares were called in %v, %v expected", records, expected)
+	}
+}
+
+// 直接返回响应或者丢弃请求的中间件
+type cacheMiddleware struct {
+	BaseDownloaderMiddleware
+	drop bool
+}
+
+func (m cacheMiddleware) ProcessRequest(req *gen.Request) (*gen.Response, error) {
+	if m.drop {
+		return nil, ErrDropRequest
+	}
+	return &gen.Response{StatusCode: http.StatusOK, Context: req.Context}, nil
+}
+
+func TestDownloaderMiddlewareShortCircuit(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+	}))
+	defer ts.Close()
+
+	for _, drop := range []bool{false, true} {
+		spider := &testSpider{url: ts.URL, num: 10}
+		crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+		crawler.UseDownloaderMiddleware(cacheMiddleware{drop: drop})
+		if err := crawler.Run(context.Background()); err != nil {
+			t.Error(err)
+		}
+		expected := int32(spider.num)
+		if drop {
+			expected = 0
+		}
+		if spider.parsed != expected {
+			t.Errorf("drop=%t, %d responses were parsed, %d expected", drop, spider.parsed, expected)
+		}
+	}
+	if count != 0 {
+		t.Errorf("%d requests were sent", count)
+	}
+}
@@ -0,0 +1,68 @@
+package talpa
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// 爬虫回调产生的数据, 如贴吧的帖子和楼层, 入队后依次经过所有 ItemPipeline 处理
+type Item interface{}
+
+// 处理数据时返回这个错误表示丢弃数据, 之后的 ItemPipeline 不会再处理这个数据
+var ErrDropItem = errors.New("talpa: item dropped")
+
+// 数据处理管道, 如验证, 补全, 存储或者导出数据. 爬虫启动时按注册顺序打开, 结束时按相同顺序关闭
+type ItemPipeline interface {
+	Open()
+	Close()
+	// 处理数据并返回交给下一个 ItemPipeline 的数据, 会被并发调用
+	ProcessItem(item Item) (Item, error)
+}
+
+type itemPipelines []ItemPipeline
+
+func (ps itemPipelines) open() {
+	for _, p := range ps {
+		p.Open()
+	}
+}
+func (ps itemPipelines) close() {
+	for _, p := range ps {
+		p.Close()
+	}
+}
+
+// 依次处理数据, 出错时停止处理并返回错误
+func (ps itemPipelines) process(item Item) error {
+	var err error
+	for _, p := range ps {
+		if item, err = p.ProcessItem(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将数据包装成交给 Scraper 执行的任务, 丢弃的数据不会当作错误记录
+func (c *Crawler) itemJob(item Item) func() {
+	return func() {
+		err := c.pipelines.process(item)
+		switch err {
+		case nil:
+			c.stats.Inc(StatsItemScraped, 1)
+			c.stats.Inc(fmt.Sprintf("%s/%T", StatsItemScraped, item), 1)
+			c.emit(Event{Signal: ItemScraped, Item: item})
+		case ErrDropItem:
+			c.stats.Inc(StatsItemDropped, 1)
+			c.emit(Event{Signal: ItemDropped, Item: item})
+			c.logger.WithField("Item", fmt.Sprintf("%T", item)).Debugln("Item was dropped")
+		default:
+			c.errs.Record(err)
+			c.stats.Inc(StatsItemFailed, 1)
+			c.emit(Event{Signal: JobFailed, Item: item, Err: err})
+			c.logger.WithFields(logrus.Fields{"Item": fmt.Sprintf("%T", item), "Error": err}).Errorln("Item was failed")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package talpa
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 每个响应产生一个序号数据
+type itemSpider struct {
+	url string
+	num int
+	seq int32
+}
+
+func (s *itemSpider) StartRequests() []*gen.Request {
+	reqs := make([]*gen.Request, s.num)
+	for i := range reqs {
+		req := gen.NewRequest().URL(s.url)
+		MetaOf(req).CallBack = s.Parse
+		reqs[i] = req
+	}
+	return reqs
+}
+
+func (s *itemSpider) Parse(res *gen.Response, h Helper) {
+	h.PutItem(int(atomic.AddInt32(&s.seq, 1)))
+}
+
+var errBadItem = errors.New("bad item")
+
+// 丢弃奇数, 数据为 2 时出错, 其他数据加倍后交给下一个管道
+type filterPipeline struct {
+	opened, closed bool
+}
+
+func (p *filterPipeline) Open()  { p.opened = true }
+func (p *filterPipeline) Close() { p.closed = true }
+func (p *filterPipeline) ProcessItem(item Item) (Item, error) {
+	switch n := item.(int); {
+	case n%2 == 1:
+		return nil, ErrDropItem
+	case n == 2:
+		return nil, errBadItem
+	default:
+		return n * 2, nil
+	}
+}
+
+type sumPipeline struct {
+	sum int64
+}
+
+func (p *sumPipeline) Open()  {}
+func (p *sumPipeline) Close() {}
+func (p *sumPipeline) ProcessItem(item Item) (Item, error) {
+	atomic.AddInt64(&p.sum, int64(item.(int)))
+	return item, nil
+}
+
+func TestItemPipeline(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	spider := &itemSpider{url: ts.URL, num: 6}
+	filter, sum := new(filterPipeline), new(sumPipeline)
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	crawler.UsePipeline(filter, sum)
+	err := crawler.Run(context.Background())
+
+	summary, ok := err.(*ErrorSummary)
+	if !ok || summary.NumErrors != 1 || summary.Errors[0] != errBadItem {
+		t.Errorf("Run returns %v, 1 item error expected", err)
+	}
+	if !filter.opened || !filter.closed {
+		t.Error("Pipeline was not opened or closed")
+	}
+	// 只有 4 和 6 通过了第一个管道
+	if sum.sum != 20 {
+		t.Errorf("Sum of items is %d, 20 expected", sum.sum)
+	}
+}
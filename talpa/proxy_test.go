@@ -0,0 +1,179 @@
+package talpa
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 代替代理的服务器, 请求经过代理时直接返回代理的名称
+func newProxyStandIns(n int, status int) ([]*httptest.Server, []string) {
+	servers := make([]*httptest.Server, n)
+	urls := make([]string, n)
+	for i := range servers {
+		name := fmt.Sprintf("p%d", i)
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(name))
+		}))
+		urls[i] = servers[i].URL
+	}
+	return servers, urls
+}
+
+func closeAll(servers []*httptest.Server) {
+	for _, s := range servers {
+		s.Close()
+	}
+}
+
+// 通过代理池中间件发送请求, 返回经过的代理名称
+func fetchThrough(pool ProxyPool, spider Spider) (string, error) {
+	req := gen.NewRequest().URL("http://tieba.example/")
+	MetaOf(req).Spider = spider
+	res, err := downloaderMiddlewares{pool}.process(req, func(req *gen.Request) (*gen.Response, error) { return req.Do() })
+	if err != nil {
+		return "", err
+	}
+	return res.String(), nil
+}
+
+func fetchN(t *testing.T, pool ProxyPool, n int) string {
+	var names []string
+	for i := 0; i < n; i++ {
+		name, err := fetchThrough(pool, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestProxyPoolStrategies(t *testing.T) {
+	servers, urls := newProxyStandIns(3, http.StatusOK)
+	defer closeAll(servers)
+
+	pool, err := NewProxyPool(urls, ProxyPoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fetchN(t, pool, 4); s != "p0 p1 p2 p0" {
+		t.Errorf("Round robin order is %q", s)
+	}
+
+	pool, _ = NewProxyPool(urls[:2], ProxyPoolOptions{Strategy: ProxyLeastUsed})
+	if s := fetchN(t, pool, 4); s != "p0 p1 p0 p1" {
+		t.Errorf("Least used order is %q", s)
+	}
+	// 重新载入后保留原有代理的使用次数, 新的代理使用次数最少
+	if err := pool.Reload(urls); err != nil {
+		t.Fatal(err)
+	}
+	if s := fetchN(t, pool, 2); s != "p2 p2" {
+		t.Errorf("Least used order after reload is %q", s)
+	}
+	if status := pool.Status(); len(status) != 3 || status[0].Used != 2 || status[2].Used != 2 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	pool, _ = NewProxyPool(urls, ProxyPoolOptions{Strategy: ProxySticky})
+	a, b := &fairSpider{name: "a"}, &fairSpider{name: "b"}
+	for i := 0; i < 3; i++ {
+		pa, _ := fetchThrough(pool, a)
+		pb, _ := fetchThrough(pool, b)
+		if pa != "p0" || pb != "p1" {
+			t.Fatalf("Spider a uses %s, b uses %s, p0 and p1 expected", pa, pb)
+		}
+	}
+}
+
+func TestProxyPoolBan(t *testing.T) {
+	servers, urls := newProxyStandIns(2, http.StatusOK)
+	defer closeAll(servers)
+	blocked, blockedURLs := newProxyStandIns(1, http.StatusForbidden)
+	defer closeAll(blocked)
+	// 已经关闭的代理, 请求会出错
+	dead, deadURLs := newProxyStandIns(1, http.StatusOK)
+	closeAll(dead)
+
+	opts := ProxyPoolOptions{BanResponse: func(res *gen.Response) bool { return res.StatusCode == http.StatusForbidden }}
+	pool, err := NewProxyPool(append(append(deadURLs, blockedURLs...), urls[0]), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fetchThrough(pool, nil); err == nil || err == ErrProxyBanned {
+		t.Errorf("Request through dead proxy returns %v, transport error expected", err)
+	}
+	if _, err := fetchThrough(pool, nil); err != ErrProxyBanned {
+		t.Errorf("Request through blocked proxy returns %v, %v expected", err, ErrProxyBanned)
+	}
+	if s := fetchN(t, pool, 2); s != "p0 p0" {
+		t.Errorf("Banned proxies were used, %q", s)
+	}
+	status := pool.Status()
+	if !status[0].Banned || !status[1].Banned || status[2].Banned || status[0].Failures != 1 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// 所有代理都被禁用时返回错误
+	pool, _ = NewProxyPool(deadURLs, ProxyPoolOptions{})
+	fetchThrough(pool, nil)
+	if _, err := fetchThrough(pool, nil); err != ErrNoProxyAvailable {
+		t.Errorf("Request returns %v while all proxies were banned, %v expected", err, ErrNoProxyAvailable)
+	}
+
+	if _, err := NewProxyPool([]string{"ftp://127.0.0.1"}, ProxyPoolOptions{}); err == nil {
+		t.Error("Unsupported proxy scheme was accepted")
+	}
+}
+
+func TestProxyPoolCheck(t *testing.T) {
+	servers, urls := newProxyStandIns(1, http.StatusOK)
+	defer closeAll(servers)
+
+	pool, err := NewProxyPool(urls, ProxyPoolOptions{BanDuration: time.Hour, CheckURL: "http://check.example/", CheckInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pp := pool.(*proxyPool)
+	pp.ban(pp.proxies[0], "test")
+	time.Sleep(time.Millisecond)
+	// 选择代理时在后台检查被禁用的代理, 检查通过后恢复使用
+	if _, err := fetchThrough(pool, nil); err != ErrNoProxyAvailable {
+		t.Fatalf("Request returns %v while the proxy was banned, %v expected", err, ErrNoProxyAvailable)
+	}
+	deadline := time.Now().Add(time.Second)
+	for pool.Status()[0].Banned && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s := fetchN(t, pool, 1); s != "p0" {
+		t.Errorf("Checked proxy was not readmitted, %q", s)
+	}
+}
+
+func TestProxyPoolPlugin(t *testing.T) {
+	servers, urls := newProxyStandIns(2, http.StatusOK)
+	defer closeAll(servers)
+
+	pool, err := NewProxyPool(urls, ProxyPoolOptions{Strategy: ProxySticky})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := gen.NewRequest()
+	base.Use(pool.Plugin())
+	for _, host := range []string{"a.example", "b.example", "a.example"} {
+		res, err := base.Clone().URL("http://" + host + "/").Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := map[string]string{"a.example": "p0", "b.example": "p1"}[host]; res.String() != expected {
+			t.Errorf("Request to %s uses %s, %s expected", host, res.String(), expected)
+		}
+	}
+}
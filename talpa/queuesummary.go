@@ -0,0 +1,111 @@
+package talpa
+
+import (
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// 队列中一组请求的数量, 按爬虫, 回调和优先级分组
+type QueueSummary struct {
+	Spider   string `json:"spider"`
+	CallBack string `json:"callback"`
+	Priority int    `json:"priority"`
+	Count    int64  `json:"count"`
+}
+
+// 可以汇总队列内容的请求调度器, 用于在运行时查看队列中还有哪些请求
+type SummarizedScheduler interface {
+	RequestScheduler
+	Summary() []QueueSummary
+}
+
+// 找到调度器本身或者被包装的 SummarizedScheduler
+func summarizedSchedulerOf(rs RequestScheduler) (SummarizedScheduler, bool) {
+	for {
+		if ss, ok := rs.(SummarizedScheduler); ok {
+			return ss, true
+		}
+		w, ok := rs.(wrappedScheduler)
+		if !ok {
+			return nil, false
+		}
+		rs = w.Unwrap()
+	}
+}
+
+// 回调使用函数地址区分, 名称只在汇总时解析, 避免入队和出队时的开销
+type queueKey struct {
+	spider   Spider
+	callBack uintptr
+	priority int
+}
+
+// 按分组记录队列中请求的数量, 请求入队和出队时更新
+type queueCounter struct {
+	mu     sync.Mutex
+	counts map[queueKey]int64
+}
+
+func newQueueCounter() *queueCounter {
+	return &queueCounter{counts: make(map[queueKey]int64)}
+}
+
+func (qc *queueCounter) add(item *requestItem, n int64) {
+	meta := MetaOf(item.Req)
+	key := queueKey{spider: meta.Spider, priority: item.Priority}
+	if meta.CallBack != nil {
+		key.callBack = reflect.ValueOf(meta.CallBack).Pointer()
+	}
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	if qc.counts[key] += n; qc.counts[key] <= 0 {
+		delete(qc.counts, key)
+	}
+}
+
+// 同一个爬虫的同名回调合并在一起, 按爬虫名称, 优先级从高到低, 回调名称排序
+func (qc *queueCounter) summary() []QueueSummary {
+	merged := make(map[QueueSummary]int64)
+	qc.mu.Lock()
+	for key, n := range qc.counts {
+		s := QueueSummary{CallBack: callBackName(key.callBack), Priority: key.priority}
+		if key.spider != nil {
+			s.Spider = SpiderName(key.spider)
+		}
+		merged[s] += n
+	}
+	qc.mu.Unlock()
+	summaries := make([]QueueSummary, 0, len(merged))
+	for s, n := range merged {
+		s.Count = n
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.Spider != b.Spider {
+			return a.Spider < b.Spider
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.CallBack < b.CallBack
+	})
+	return summaries
+}
+
+// 回调的名称, 爬虫的方法值只保留方法名, 其他函数使用完整的函数名
+func callBackName(pc uintptr) string {
+	if pc == 0 {
+		return ""
+	}
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return "?"
+	}
+	if name, err := methodNameOf(f.Name()); err == nil {
+		return name
+	}
+	return f.Name()
+}
@@ -0,0 +1,103 @@
+package talpa
+
+import (
+	"sync"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 令牌桶限速的配置
+type RateLimit struct {
+	// 每秒产生的令牌数, 即平均每秒发送的请求数, 不大于 0 时不限速
+	Rate float64
+	// 桶的容量, 即允许突发发送的请求数, 小于 1 时为 1
+	Burst int
+}
+
+// 得到请求所属的接口类别, 由构造请求的函数设置在 Context 的 "Endpoint" 中, 没有设置时返回空字符串
+func Endpoint(req *gen.Request) string {
+	return req.Context.GetString("Endpoint")
+}
+
+// 令牌桶, 令牌可以为负数, 表示已经预约了之后产生的令牌
+type tokenBucket struct {
+	limit RateLimit
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: time.Now()}
+}
+
+// 取出一个令牌, 返回需要等待的时间
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if burst := float64(b.limit.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.limit.Rate * float64(time.Second))
+}
+
+// 按接口限速, 接口为请求的类别, 没有类别时为 "主机/路径", 如 "c.tieba.baidu.com/c/f/frs/page"
+type rateLimiter struct {
+	// 创建后只读, 并发访问不需要加锁, 每个令牌桶有自己的锁
+	buckets map[string]*tokenBucket
+}
+
+func newRateLimiter(limits map[string]RateLimit) *rateLimiter {
+	buckets := make(map[string]*tokenBucket, len(limits))
+	for key, limit := range limits {
+		if limit.Rate > 0 {
+			buckets[key] = newTokenBucket(limit)
+		}
+	}
+	return &rateLimiter{buckets: buckets}
+}
+
+// 得到请求对应的接口和令牌桶, 类别和主机路径都没有配置时返回 nil
+func (l *rateLimiter) bucket(req *gen.Request) (string, *tokenBucket) {
+	if len(l.buckets) == 0 {
+		return "", nil
+	}
+	key := Endpoint(req)
+	if b, ok := l.buckets[key]; ok {
+		return key, b
+	}
+	raw, err := RawRequest(req)
+	if err != nil {
+		return "", nil
+	}
+	key = raw.URL.Host + raw.URL.Path
+	if b, ok := l.buckets[key]; ok {
+		return key, b
+	}
+	return "", nil
+}
+
+// 等待直到请求对应的接口有可用的令牌, 返回接口和等待的时间, 需要等待时先调用 onWait
+func (l *rateLimiter) wait(req *gen.Request, onWait func()) (string, time.Duration) {
+	key, b := l.bucket(req)
+	if b == nil {
+		return "", 0
+	}
+	wait := b.reserve(time.Now())
+	if wait > 0 {
+		onWait()
+		time.Sleep(wait)
+	}
+	return key, wait
+}
@@ -0,0 +1,81 @@
+package talpa
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(RateLimit{Rate: 10, Burst: 2})
+	now := b.last
+	// 桶满时可以突发 Burst 个请求, 之后每个请求等待 1/Rate 秒
+	expected := []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond}
+	for i, e := range expected {
+		if wait := b.reserve(now); wait != e {
+			t.Errorf("Request %d waits %v, %v expected", i, wait, e)
+		}
+	}
+	// 令牌恢复后不需要等待, 但不会超过 Burst
+	if wait := b.reserve(now.Add(time.Second)); wait != 0 {
+		t.Errorf("Request waits %v after refill, 0 expected", wait)
+	}
+	if b.tokens > 2 {
+		t.Errorf("Tokens are %v, no more than burst expected", b.tokens)
+	}
+}
+
+func TestRateLimiterEndpoint(t *testing.T) {
+	l := newRateLimiter(map[string]RateLimit{
+		"list":                   {Rate: 1},
+		"example.com/thread":     {Rate: 1},
+		"example.com/disabled":   {Rate: 0},
+		"example.com/list/other": {Rate: 1},
+	})
+	endpoint := gen.NewRequest().URL("http://example.com/list/other")
+	endpoint.Context.Set("Endpoint", "list")
+	cases := []struct {
+		req *gen.Request
+		key string
+	}{
+		// 接口类别优先于主机路径
+		{endpoint, "list"},
+		{gen.NewRequest().URL("http://example.com/thread?id=1"), "example.com/thread"},
+		{gen.NewRequest().URL("http://example.com/disabled"), ""},
+		{gen.NewRequest().URL("http://example.com/other"), ""},
+	}
+	for _, c := range cases {
+		if key, _ := l.bucket(c.req); key != c.key {
+			t.Errorf("Request %s uses %q, %q expected", c.req.Context.Request.URL, key, c.key)
+		}
+	}
+}
+
+func TestCrawlerRateLimit(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL + "/limited")
+	key := u.Host + u.Path
+	spider := &testSpider{url: u.String(), num: 10}
+	d := NewDownloaderWithOptions(DownloaderOptions{
+		Concurrency: 4,
+		RateLimits:  map[string]RateLimit{key: {Rate: 100, Burst: 2}},
+	})
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), d, NewJobScheduler(10), NewScraper(2))
+	start := time.Now()
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Error(err)
+	}
+	// 前两个请求立即发送, 之后每 10ms 发送一个
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Errorf("10 requests were sent in %v, at least 80ms expected", elapsed)
+	}
+	counters := crawler.Stats().Counters
+	if counters[StatsRateLimitWait] == 0 || counters[StatsRateLimitWait+"/"+key] != counters[StatsRateLimitWait] {
+		t.Errorf("Wait time was not recorded: %v", counters)
+	}
+}
@@ -0,0 +1,57 @@
+package talpa
+
+import (
+	"fmt"
+	"net/http"
+
+	thttp "github.com/go-tgod/tgod/http"
+	gen "gopkg.in/h2non/gentleman.v2"
+	"gopkg.in/h2non/gentleman.v2/utils"
+)
+
+// 复制请求, gentleman 的 Clone 只浅复制了 http.Request, 副本与原请求共用请求头, 默认的空请求体以及元数据,
+// 同时发送或者处理副本和原请求会产生数据竞争, 这里同时复制请求头.
+// 请求体由插件在发送时设置, 没有内容长度时说明还是默认的空请求体, 替换为新的空请求体
+func cloneRequest(req *gen.Request) *gen.Request {
+	clone := req.Clone()
+	raw := clone.Context.Request
+	raw.Header = raw.Header.Clone()
+	if raw.ContentLength == 0 {
+		raw.Body = utils.NopCloser()
+	}
+	// 元数据以指针保存, 需要复制一份避免修改副本时影响原请求
+	if m, ok := clone.Context.Get(metaKey{}).(*RequestMeta); ok {
+		clone.Context.Set(metaKey{}, m.clone())
+	}
+	return clone
+}
+
+// gentleman 的请求方法, 地址, 请求体和请求头都是通过 "request" 阶段的插件设置的,
+// 在发送之前无法直接得到, 这里对请求的副本执行 "request" 阶段的插件得到实际发送的 http.Request
+func RawRequest(req *gen.Request) (*http.Request, error) {
+	clone := cloneRequest(req)
+	ctx := clone.Middleware.Run("request", clone.Context)
+	if ctx.Error != nil {
+		return nil, ctx.Error
+	}
+	return ctx.Request, nil
+}
+
+// 计算请求的指纹, 用于请求去重
+func Fingerprint(req *gen.Request) (string, error) {
+	_, fp, err := rawFingerprint(req)
+	return fp, err
+}
+
+// 同时返回实际发送的请求和请求的指纹, 指纹与 thttp.Fingerprint(false) 插件计算的相同
+func rawFingerprint(req *gen.Request) (*http.Request, string, error) {
+	raw, err := RawRequest(req)
+	if err != nil {
+		return nil, "", err
+	}
+	fp, err := thttp.RequestFingerprint(raw, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return raw, fmt.Sprintf("%x", fp), nil
+}
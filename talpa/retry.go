@@ -0,0 +1,109 @@
+package talpa
+
+import (
+	"net/http"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+	genc "gopkg.in/h2non/gentleman.v2/context"
+)
+
+// 请求重试策略, 发送出错的请求总是会重试, 响应是否需要重试由 RetryResponse 判断.
+// 重试的请求在等待退避时间后重新入队, 已经重试的次数记录在元数据的 RetryTimes 中
+type RetryPolicy struct {
+	// 最大重试次数
+	MaxRetries int
+	// 第一次重试前的等待时间, 之后每次重试等待时间加倍
+	Backoff time.Duration
+	// 最大等待时间, 为 0 表示不限制
+	MaxBackoff time.Duration
+	// 每次重试时对请求优先级的调整, 为负数时重试的请求会排在其他请求之后
+	PriorityAdjust int
+	// 判断响应是否需要重试, 为 nil 时使用 DefaultRetryResponse
+	RetryResponse func(res *gen.Response) bool
+}
+
+// 默认对服务器错误, 请求超时和请求过多的响应进行重试
+func DefaultRetryResponse(res *gen.Response) bool {
+	switch res.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// 请求已经重试的次数
+func RetryTimes(ctx *genc.Context) int {
+	m, _ := metaFromContext(ctx)
+	return m.RetryTimes
+}
+
+// 第 times 次重试前的等待时间
+func (p *RetryPolicy) backoff(times int) time.Duration {
+	backoff := p.Backoff
+	for i := 1; i < times; i++ {
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff >= p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// 没有发送过的请求副本, 保存在请求的 Context 中
+type retryOriginKey struct{}
+
+type retryMiddleware struct {
+	BaseDownloaderMiddleware
+	policy RetryPolicy
+}
+
+var _ DownloaderMiddleware = (*retryMiddleware)(nil)
+
+// 发送过的请求不能再次发送, 保留一个没有发送过的副本用于重试
+func (m *retryMiddleware) ProcessRequest(req *gen.Request) (*gen.Response, error) {
+	req.Context.Set(retryOriginKey{}, cloneRequest(req))
+	return nil, nil
+}
+func (m *retryMiddleware) ProcessResponse(req *gen.Request, res *gen.Response) (*gen.Response, error) {
+	retryResponse := m.policy.RetryResponse
+	if retryResponse == nil {
+		retryResponse = DefaultRetryResponse
+	}
+	if retryResponse(res) {
+		if err := m.retry(req); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+func (m *retryMiddleware) ProcessError(req *gen.Request, res *gen.Response, err error) (*gen.Response, error) {
+	if rerr := m.retry(req); rerr != nil {
+		return res, rerr
+	}
+	return res, err
+}
+
+// 需要重试时返回 *RescheduleError, 超过最大重试次数时返回 nil
+func (m *retryMiddleware) retry(req *gen.Request) error {
+	origin, ok := req.Context.Get(retryOriginKey{}).(*gen.Request)
+	if !ok {
+		return nil
+	}
+	times := RetryTimes(req.Context) + 1
+	if times > m.policy.MaxRetries {
+		return nil
+	}
+	meta := MetaOf(origin)
+	meta.RetryTimes = times
+	meta.Priority += m.policy.PriorityAdjust
+	// 重试的请求与原请求相同, 不能被去重过滤
+	meta.DontFilter = true
+	return &RescheduleError{Request: origin, Delay: m.policy.backoff(times)}
+}
+
+// 根据重试策略对出错的请求和需要重试的响应进行重试的下载器中间件
+func NewRetryMiddleware(policy RetryPolicy) DownloaderMiddleware {
+	return &retryMiddleware{policy: policy}
+}
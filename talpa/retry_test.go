@@ -0,0 +1,110 @@
+package talpa
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 记录回调时的重试次数
+type retrySpider struct {
+	url        string
+	retryTimes int32
+	failed     int32
+}
+
+func (s *retrySpider) StartRequests() []*gen.Request {
+	req := gen.NewRequest().URL(s.url)
+	MetaOf(req).CallBack = s.Parse
+	MetaOf(req).ErrBack = s.Fail
+	return []*gen.Request{req}
+}
+func (s *retrySpider) Parse(res *gen.Response, h Helper) {
+	atomic.StoreInt32(&s.retryTimes, int32(RetryTimes(res.Context)))
+}
+func (s *retrySpider) Fail(res *gen.Response) {
+	atomic.StoreInt32(&s.retryTimes, int32(RetryTimes(res.Context)))
+	atomic.AddInt32(&s.failed, 1)
+}
+
+func retryDownloader(maxRetries int) Downloader {
+	d := NewDownloader(2)
+	d.Use(NewRetryMiddleware(RetryPolicy{MaxRetries: maxRetries, Backoff: time.Millisecond, PriorityAdjust: -1}))
+	return d
+}
+
+func TestRetryResponse(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	spider := &retrySpider{url: ts.URL}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), retryDownloader(3), nil, nil)
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if count != 3 || spider.retryTimes != 2 {
+		t.Errorf("Request was sent %d times, RetryTimes is %d", count, spider.retryTimes)
+	}
+}
+
+func TestRetryError(t *testing.T) {
+	ts := newTestServer(0)
+	// 关闭服务器使请求出错
+	ts.Close()
+
+	spider := &retrySpider{url: ts.URL}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), retryDownloader(2), nil, nil)
+	err := crawler.Run(context.Background())
+	summary, ok := err.(*ErrorSummary)
+	if !ok || summary.NumErrors != 1 {
+		t.Errorf("Run returns %v, 1 error expected", err)
+	}
+	if spider.failed != 1 || spider.retryTimes != 2 {
+		t.Errorf("ErrBack was called %d times, RetryTimes is %d", spider.failed, spider.retryTimes)
+	}
+}
+
+func TestRetryAfterStop(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	d := NewDownloader(2)
+	d.Use(NewRetryMiddleware(RetryPolicy{MaxRetries: 3, Backoff: 100 * time.Millisecond}))
+	crawler := NewCrawler([]Spider{&retrySpider{url: ts.URL}}, NewRequestScheduler(10), d, nil, nil)
+	crawler.Start()
+	for atomic.LoadInt32(&count) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// 停止时请求还在等待重试, 重新入队的请求应该被丢弃
+	crawler.Stop()
+	time.Sleep(200 * time.Millisecond)
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Errorf("Request was sent %d times after Stop", n)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	for times, expected := range []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		if times == 0 {
+			continue
+		}
+		if backoff := p.backoff(times); backoff != expected {
+			t.Errorf("Backoff of retry %d is %s, %s expected", times, backoff, expected)
+		}
+	}
+}
@@ -21,29 +21,9 @@ type RequestScheduler interface {
 	Get(number int64) []*gen.Request
 }
 
-func newRequestItem(req *gen.Request) (queue.Item, error) {
-	var err error
-	reqItem := new(requestItem)
-	reqItem.Req = req
-	pri := req.Context.Get("Priority")
-	if pri == nil {
-		reqItem.Priority = 0
-	} else {
-		func() {
-			// 处理Priority类型断言出错
-			defer func() {
-				pv := recover()
-				if pv != nil {
-					err = fmt.Errorf("Priority type itemScheduler %T, int itemScheduler expected.", pri)
-				}
-			}()
-			reqItem.Priority = pri.(int)
-		}()
-	}
-	if err != nil {
-		return reqItem, err
-	}
-	return reqItem, nil
+// 优先级在入队时确定, 入队后修改元数据中的优先级不会改变请求的顺序
+func newRequestItem(req *gen.Request) queue.Item {
+	return &requestItem{Req: req, Priority: MetaOf(req).Priority}
 }
 
 type requestItem struct {
@@ -70,12 +50,13 @@ func (ri requestItem) Compare(other queue.Item) int {
 }
 
 type requestScheduler struct {
-	pq *queue.PriorityQueue
+	pq      *queue.PriorityQueue
+	counter *queueCounter
 
 	logger *logrus.Entry
 }
 
-var _ RequestScheduler = (*requestScheduler)(nil)
+var _ SummarizedScheduler = (*requestScheduler)(nil)
 
 func (rs *requestScheduler) Dispose() {
 	rs.pq.Dispose()
@@ -96,11 +77,11 @@ func (rs *requestScheduler) Put(reqs ...*gen.Request) {
 		if req == nil {
 			rs.logger.Panicln("Cann't push a nil request into queue!")
 		}
-		item, err := newRequestItem(req)
-		if err != nil {
-			rs.logger.Panicln(err)
-		}
-		reqItems[i] = item
+		reqItems[i] = newRequestItem(req)
+	}
+	// 入队后请求可能立即被其他 goroutine 取出, 需要在入队前计数, 否则出队的计数可能先于入队
+	for _, item := range reqItems {
+		rs.counter.add(item.(*requestItem), 1)
 	}
 	// 批量入队能避免频繁地使用锁
 	if err := rs.pq.Put(reqItems...); err != nil {
@@ -115,14 +96,19 @@ func (rs *requestScheduler) Get(number int64) []*gen.Request {
 	}
 	reqs := make([]*gen.Request, len(items))
 	for i, item := range items {
+		rs.counter.add(item.(*requestItem), -1)
 		reqs[i] = item.(*requestItem).Req
 	}
 	return reqs
 }
+func (rs *requestScheduler) Summary() []QueueSummary {
+	return rs.counter.summary()
+}
 
 func NewRequestScheduler(hint int64) RequestScheduler {
 	rs := new(requestScheduler)
 	rs.pq = queue.NewPriorityQueue(int(hint), false)
+	rs.counter = newQueueCounter()
 
 	rs.logger = Logger.WithField("RequestScheduler", fmt.Sprintf("%p", rs))
 	return rs
@@ -10,7 +10,8 @@ import (
 type Scraper interface {
 	Open()
 	Close()
-	Send(job func())
+	// 异步执行任务, 任务完成后调用 done, 任务没有被执行时 err 为出错的原因
+	Send(job func(), done func(err error))
 	NumWaitingJobs() int
 	NumWorkers() int
 }
@@ -38,13 +39,15 @@ func (s *scraper) Close() {
 	}
 	s.logger.Infoln("Scraper closed")
 }
-func (s *scraper) Send(job func()) {
+func (s *scraper) Send(job func(), done func(err error)) {
 	entry := s.logger.WithField("Job", fmt.Sprintf("%p", job))
 	s.pool.SendWorkAsync(job, func(_ interface{}, err error) {
 		if err != nil {
-			s.logger.Panicln(err)
+			entry.WithField("Error", err).Errorln("Job was not finished")
+		} else {
+			entry.Debugln("Job was finished")
 		}
-		entry.Debugln("Job was finished")
+		done(err)
 	})
 	entry.Debugln("Item was sent")
 }
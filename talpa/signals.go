@@ -0,0 +1,121 @@
+package talpa
+
+import (
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// Crawler 运行过程中发出的信号
+type Signal int
+
+const (
+	// Crawler 启动, 初始请求已经入队
+	CrawlerStarted Signal = iota
+	// 爬虫开始运行, 在获取初始请求之前发出
+	SpiderOpened
+	// 请求入队, 在放入队列之前发出
+	RequestScheduled
+	// 请求被下载器中间件丢弃
+	RequestDropped
+	// 请求出错, Err 为出错的原因
+	RequestFailed
+	// 收到响应, 在执行回调之前发出
+	ResponseReceived
+	// 数据经过所有 ItemPipeline 处理完成
+	ItemScraped
+	// 数据被 ItemPipeline 丢弃
+	ItemDropped
+	// 任务出错, Err 为出错的原因
+	JobFailed
+	// 请求队列为空且没有在途请求, 处理函数可以通过 Helper 添加新的请求让爬虫继续运行
+	SpiderIdle
+	// 爬虫的请求都已处理完成并且空闲时没有产生新的请求, 之后有新的请求入队时会再次发出 SpiderOpened
+	SpiderClosed
+	// Crawler 暂停, 不再分发新的请求和任务
+	CrawlerPaused
+	// Crawler 从暂停中恢复
+	CrawlerResumed
+	// Crawler 的所有工作都已结束
+	CrawlerClosed
+)
+
+var signalNames = [...]string{
+	"CrawlerStarted", "SpiderOpened", "RequestScheduled", "RequestDropped", "RequestFailed",
+	"ResponseReceived", "ItemScraped", "ItemDropped", "JobFailed", "SpiderIdle", "SpiderClosed",
+	"CrawlerPaused", "CrawlerResumed", "CrawlerClosed",
+}
+
+func (s Signal) String() string {
+	if s < 0 || int(s) >= len(signalNames) {
+		return "Signal(?)"
+	}
+	return signalNames[s]
+}
+
+// 信号携带的数据, 根据信号的不同只会设置部分字段
+type Event struct {
+	Signal   Signal
+	Crawler  *Crawler
+	Spider   Spider
+	Request  *gen.Request
+	Response *gen.Response
+	Item     Item
+	Err      error
+	// 只在 SpiderIdle 中设置, 用于将新的请求添加到对应的爬虫
+	Helper Helper
+}
+
+// 信号处理函数, 在发出信号的 goroutine 中同步调用, 需要尽快返回并且是并发安全的
+type SignalHandler func(e *Event)
+
+type signalBus struct {
+	mu       sync.RWMutex
+	handlers map[Signal][]SignalHandler
+}
+
+func (b *signalBus) connect(sig Signal, h SignalHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.handlers == nil {
+		b.handlers = make(map[Signal][]SignalHandler)
+	}
+	b.handlers[sig] = append(b.handlers[sig], h)
+}
+
+func (b *signalBus) connected(sig Signal) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.handlers[sig]) > 0
+}
+
+// 依次调用处理函数, 处理函数中的 panic 只会被记录, 不会影响其他处理函数和爬虫的运行
+func (b *signalBus) send(e *Event, logger *logrus.Entry) {
+	b.mu.RLock()
+	handlers := b.handlers[e.Signal]
+	b.mu.RUnlock()
+	for _, h := range handlers {
+		func() {
+			defer func() {
+				if v := recover(); v != nil {
+					logger.WithFields(logrus.Fields{"Signal": e.Signal, "Error": newPanicError(v)}).Errorln("Signal handler panicked")
+				}
+			}()
+			h(e)
+		}()
+	}
+}
+
+// 注册信号处理函数, 可以在爬虫运行时调用
+func (c *Crawler) Connect(sig Signal, h SignalHandler) {
+	c.signals.connect(sig, h)
+}
+
+func (c *Crawler) emit(e Event) {
+	if !c.signals.connected(e.Signal) {
+		return
+	}
+	e.Crawler = c
+	c.signals.send(&e, c.logger)
+}
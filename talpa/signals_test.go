@@ -0,0 +1,79 @@
+package talpa
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 丢弃自定义元数据中带有 "Drop" 标记的请求
+type dropMiddleware struct {
+	BaseDownloaderMiddleware
+}
+
+func (dropMiddleware) ProcessRequest(req *gen.Request) (*gen.Response, error) {
+	if MetaOf(req).Meta["Drop"] == true {
+		return nil, ErrDropRequest
+	}
+	return nil, nil
+}
+
+func TestCrawlerSignals(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	spider := &itemSpider{url: ts.URL, num: 2}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	crawler.UseDownloaderMiddleware(dropMiddleware{})
+
+	var mu sync.Mutex
+	counts := make(map[Signal]int)
+	for sig := CrawlerStarted; sig <= CrawlerClosed; sig++ {
+		crawler.Connect(sig, func(e *Event) {
+			mu.Lock()
+			counts[e.Signal]++
+			mu.Unlock()
+		})
+	}
+	// 处理函数中的 panic 不会影响爬虫运行
+	crawler.Connect(ResponseReceived, func(e *Event) { panic("handler") })
+	// 第一次空闲时再添加一个正常请求和一个会被丢弃的请求
+	idled := false
+	crawler.Connect(SpiderIdle, func(e *Event) {
+		if idled {
+			return
+		}
+		idled = true
+		if e.Spider != spider {
+			t.Errorf("SpiderIdle for %v, %v expected", e.Spider, spider)
+		}
+		req := gen.NewRequest().URL(ts.URL)
+		MetaOf(req).CallBack = spider.Parse
+		dropped := gen.NewRequest().URL(ts.URL)
+		MetaOf(dropped).CallBack = spider.Parse
+		MetaOf(dropped).Meta = map[string]interface{}{"Drop": true}
+		e.Helper.PutRequest(req, dropped)
+	})
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[Signal]int{
+		CrawlerStarted:   1,
+		SpiderOpened:     1,
+		RequestScheduled: 4,
+		RequestDropped:   1,
+		ResponseReceived: 3,
+		ItemScraped:      3,
+		SpiderIdle:       2,
+		SpiderClosed:     1,
+		CrawlerClosed:    1,
+	}
+	for sig, n := range expected {
+		if counts[sig] != n {
+			t.Errorf("%s was sent %d times, %d expected", sig, counts[sig], n)
+		}
+	}
+}
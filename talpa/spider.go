@@ -1,33 +1,154 @@
 package talpa
 
 import (
+	"fmt"
+	"net/url"
+	"time"
+
 	gen "gopkg.in/h2non/gentleman.v2"
 )
 
 // 用于定义爬虫的接口类型
 type Spider interface {
 	// 生成初始的请求
-	// 所有生成的请求都需要在Context设置一个"CallBack"用于对响应的解析
-	// 可选的, 可以设置一个"ErrBack"用于处理发送请求时可能产生的错误
+	// 所有生成的请求都需要在元数据中设置 CallBack 用于对响应的解析, 见 RequestMeta
 	StartRequests() []*gen.Request
 }
 
+// 可选的爬虫名称接口, 持久化请求时根据名称找到请求所属的爬虫
+type NamedSpider interface {
+	Spider
+	Name() string
+}
+
+// 可选的空闲爬虫接口, 请求队列为空且没有在途请求时调用, 用于持续运行的爬虫定期产生新的请求.
+// 没有新的请求时返回空, 只在设置了 Crawler.SetKeepAlive 时调用, 并且会被反复调用
+type IdleSpider interface {
+	Spider
+	Idle() []*gen.Request
+}
+
+// 可选的爬虫接口, 根据参数构造临时的请求, 用于在运行时通过管理接口添加请求.
+// kind 为请求的类型, 由爬虫自己定义, 类型不支持或者参数错误时返回错误
+type AdhocSpider interface {
+	Spider
+	AdhocRequest(kind string, params url.Values) (*gen.Request, error)
+}
+
+// 爬虫的名称, 没有实现 NamedSpider 时使用爬虫的类型名
+func SpiderName(s Spider) string {
+	if ns, ok := s.(NamedSpider); ok {
+		return ns.Name()
+	}
+	return fmt.Sprintf("%T", s)
+}
+
+// 请求所属的爬虫, 由 Crawler 在请求入队时设置到元数据中
+func spiderOf(req *gen.Request) Spider {
+	return MetaOf(req).Spider
+}
+
+// 标记请求所属的爬虫, 已经标记过的请求不会被修改
+func markSpider(s Spider, reqs []*gen.Request) {
+	for _, req := range reqs {
+		if m := MetaOf(req); m.Spider == nil {
+			m.Spider = s
+		}
+	}
+}
+
+// 记录错误日志的请求出错处理函数, 可以设置为请求的 "ErrBack".
+// 没有设置 ErrBack 的请求出错时交给 Crawler 的错误处理函数
+var DefaultErrBack = func(res *gen.Response) {
+	Logger.Errorln(res.Error)
+}
+
 // 提供给响应回调的参数, 用于将新的请求或者需要处理的内容入队
 type Helper interface {
 	PutRequest(reqs ...*gen.Request)
+	// 数据入队后由 Crawler 的 ItemPipeline 处理
+	PutItem(items ...Item)
+	// 入队任意的任务, 新的代码应当使用 PutItem
 	PutJob(jobs ...func())
+	// Crawler 的统计, 回调可以记录自定义的统计信息
+	Stats() *Stats
 }
 
 var _ Helper = (*helper)(nil)
 
 type helper struct {
-	rs RequestScheduler
-	is JobScheduler
+	crawler *Crawler
+	spider  Spider
+	// 通过这个 helper 产生的请求的深度, 初始请求为 0, 回调中为原请求的深度加 1
+	depth int
+	// 回调中使用的 helper 在队列达到上限时等待, 见 Crawler.SetQueueLimits
+	bounded bool
 }
 
+// 入队, 回调中队列达到上限时等待并记录等待的时间, waiting 见 queueBound.put
+func (h *helper) putBounded(b *queueBound, n int, key string, waiting *int64, put func()) {
+	if !h.bounded {
+		put()
+		return
+	}
+	if wait := b.put(n, waiting, put); wait > 0 {
+		h.crawler.stats.Inc(key, int64(wait/time.Millisecond))
+	}
+}
+
+// 回调产生的请求与原请求属于同一个爬虫, 第一次入队的请求记录深度, 入队后唤醒对应的分发循环
 func (h *helper) PutRequest(reqs ...*gen.Request) {
-	h.rs.Put(reqs...)
+	if len(reqs) == 0 {
+		return
+	}
+	for _, req := range reqs {
+		if err := ValidateRequest(req); err != nil {
+			h.crawler.logger.Panicln(err)
+		}
+	}
+	markSpider(h.spider, reqs)
+	for _, req := range reqs {
+		if m := MetaOf(req); !m.scheduled {
+			m.Depth = h.depth
+			m.scheduled = true
+		}
+	}
+	h.crawler.stats.Max(StatsRequestDepth, int64(h.depth))
+	// 入队后请求可能已经在其他 goroutine 中发送, 不能再读取请求的 Context, 信号和所属的爬虫都需要在入队前得到
+	spiders := make([]Spider, len(reqs))
+	for i, req := range reqs {
+		spiders[i] = spiderOf(req)
+		h.crawler.emit(Event{Signal: RequestScheduled, Spider: h.spider, Request: req})
+	}
+	var dropped bool
+	h.putBounded(h.crawler.requestBound, len(reqs), StatsBackpressureRequestWait, h.crawler.spiderWaiting(h.spider), func() {
+		dropped = !h.crawler.putRequest(reqs)
+	})
+	if dropped {
+		h.crawler.logger.WithField("NumRequest", len(reqs)).Warnln("Request loop was closed, requests dropped")
+		return
+	}
+	h.crawler.stats.Inc(StatsRequestScheduled, int64(len(reqs)))
+	h.crawler.stats.Max(StatsQueueRequest, h.crawler.requestScheduler.Len())
+	for _, s := range spiders {
+		h.crawler.reopenSpider(s)
+	}
+	notify(h.crawler.requestSignal)
+}
+func (h *helper) PutItem(items ...Item) {
+	jobs := make([]func(), len(items))
+	for i, item := range items {
+		jobs[i] = h.crawler.itemJob(item)
+	}
+	h.PutJob(jobs...)
 }
 func (h *helper) PutJob(jobs ...func()) {
-	h.is.Put(jobs...)
+	h.putBounded(h.crawler.jobBound, len(jobs), StatsBackpressureJobWait, nil, func() {
+		h.crawler.jobScheduler.Put(jobs...)
+	})
+	h.crawler.stats.Max(StatsQueueJob, h.crawler.jobScheduler.Len())
+	notify(h.crawler.jobSignal)
+}
+func (h *helper) Stats() *Stats {
+	return h.crawler.stats
 }
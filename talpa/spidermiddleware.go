@@ -0,0 +1,125 @@
+package talpa
+
+import (
+	"github.com/Sirupsen/logrus"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 爬虫中间件, 用于处理爬虫回调产生的请求和任务, 如过滤, 修改或者标记请求.
+// 中间件按注册顺序依次调用
+type SpiderMiddleware interface {
+	// 处理回调产生的请求, 返回实际入队的请求, 处理初始请求时 res 为 nil
+	ProcessRequests(res *gen.Response, reqs []*gen.Request) []*gen.Request
+	// 处理回调产生的数据, 返回实际入队的数据
+	ProcessItems(res *gen.Response, items []Item) []Item
+	// 处理回调产生的任务, 返回实际入队的任务
+	ProcessJobs(res *gen.Response, jobs []func()) []func()
+	// 回调中出现 panic 时调用, 返回 true 表示错误已经被处理, 之后的中间件不会再被调用
+	ProcessCallbackError(res *gen.Response, err *PanicError) bool
+}
+
+// 不做任何处理的爬虫中间件, 可以嵌入到其他中间件中只实现需要的方法
+type BaseSpiderMiddleware struct{}
+
+func (BaseSpiderMiddleware) ProcessRequests(res *gen.Response, reqs []*gen.Request) []*gen.Request {
+	return reqs
+}
+func (BaseSpiderMiddleware) ProcessItems(res *gen.Response, items []Item) []Item {
+	return items
+}
+func (BaseSpiderMiddleware) ProcessJobs(res *gen.Response, jobs []func()) []func() {
+	return jobs
+}
+func (BaseSpiderMiddleware) ProcessCallbackError(res *gen.Response, err *PanicError) bool {
+	return false
+}
+
+var _ SpiderMiddleware = BaseSpiderMiddleware{}
+
+type spiderMiddlewares []SpiderMiddleware
+
+func (ms spiderMiddlewares) processRequests(res *gen.Response, reqs []*gen.Request) []*gen.Request {
+	for _, m := range ms {
+		if len(reqs) == 0 {
+			break
+		}
+		reqs = m.ProcessRequests(res, reqs)
+	}
+	return reqs
+}
+func (ms spiderMiddlewares) processItems(res *gen.Response, items []Item) []Item {
+	for _, m := range ms {
+		if len(items) == 0 {
+			break
+		}
+		items = m.ProcessItems(res, items)
+	}
+	return items
+}
+func (ms spiderMiddlewares) processJobs(res *gen.Response, jobs []func()) []func() {
+	for _, m := range ms {
+		if len(jobs) == 0 {
+			break
+		}
+		jobs = m.ProcessJobs(res, jobs)
+	}
+	return jobs
+}
+func (ms spiderMiddlewares) processCallbackError(res *gen.Response, err *PanicError) bool {
+	for _, m := range ms {
+		if m.ProcessCallbackError(res, err) {
+			return true
+		}
+	}
+	return false
+}
+
+// 回调中使用的 helper, 请求和任务入队前先经过爬虫中间件处理
+type middlewareHelper struct {
+	Helper
+	res *gen.Response
+	ms  spiderMiddlewares
+}
+
+func (h *middlewareHelper) PutRequest(reqs ...*gen.Request) {
+	if reqs = h.ms.processRequests(h.res, reqs); len(reqs) > 0 {
+		h.Helper.PutRequest(reqs...)
+	}
+}
+func (h *middlewareHelper) PutItem(items ...Item) {
+	if items = h.ms.processItems(h.res, items); len(items) > 0 {
+		h.Helper.PutItem(items...)
+	}
+}
+func (h *middlewareHelper) PutJob(jobs ...func()) {
+	if jobs = h.ms.processJobs(h.res, jobs); len(jobs) > 0 {
+		h.Helper.PutJob(jobs...)
+	}
+}
+
+type urlLengthMiddleware struct {
+	BaseSpiderMiddleware
+	max int
+
+	logger *logrus.Entry
+}
+
+func (m *urlLengthMiddleware) ProcessRequests(res *gen.Response, reqs []*gen.Request) []*gen.Request {
+	filtered := make([]*gen.Request, 0, len(reqs))
+	for _, req := range reqs {
+		raw, err := RawRequest(req)
+		if err == nil && len(raw.URL.String()) > m.max {
+			m.logger.WithField("URL", raw.URL.String()).Debugln("Request was dropped")
+			continue
+		}
+		filtered = append(filtered, req)
+	}
+	return filtered
+}
+
+// 丢弃地址长度超过 max 的请求的爬虫中间件
+func NewURLLengthMiddleware(max int) SpiderMiddleware {
+	m := &urlLengthMiddleware{max: max}
+	m.logger = Logger.WithField("SpiderMiddleware", "URLLength")
+	return m
+}
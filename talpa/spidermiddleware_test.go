@@ -0,0 +1,75 @@
+package talpa
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 对每个初始请求的响应再产生一个长地址请求和一个会 panic 的请求
+type followSpider struct {
+	url    string
+	parsed int32
+	jobs   int32
+}
+
+func (s *followSpider) StartRequests() []*gen.Request {
+	req := gen.NewRequest().URL(s.url)
+	MetaOf(req).CallBack = s.Parse
+	return []*gen.Request{req}
+}
+
+func (s *followSpider) Parse(res *gen.Response, h Helper) {
+	atomic.AddInt32(&s.parsed, 1)
+	long := gen.NewRequest().URL(s.url + "/" + strings.Repeat("a", 100))
+	MetaOf(long).CallBack = s.Parse
+	broken := gen.NewRequest().URL(s.url + "/broken")
+	MetaOf(broken).CallBack = s.Broken
+	h.PutRequest(long, broken)
+	h.PutJob(func() { atomic.AddInt32(&s.jobs, 1) }, func() { atomic.AddInt32(&s.jobs, 1) })
+}
+
+func (s *followSpider) Broken(res *gen.Response, h Helper) {
+	panic("broken")
+}
+
+// 每个响应最多保留一个任务, 并处理回调中的 panic
+type testSpiderMiddleware struct {
+	BaseSpiderMiddleware
+	errors int32
+}
+
+func (m *testSpiderMiddleware) ProcessJobs(res *gen.Response, jobs []func()) []func() {
+	return jobs[:1]
+}
+func (m *testSpiderMiddleware) ProcessCallbackError(res *gen.Response, err *PanicError) bool {
+	if err.Value == "broken" && len(err.Stack) > 0 {
+		atomic.AddInt32(&m.errors, 1)
+	}
+	return true
+}
+
+func TestSpiderMiddleware(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	spider := &followSpider{url: ts.URL}
+	m := new(testSpiderMiddleware)
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	crawler.UseSpiderMiddleware(NewURLLengthMiddleware(len(ts.URL)+50), m)
+	if err := crawler.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if spider.parsed != 1 {
+		t.Errorf("%d responses were parsed, long URL should be dropped", spider.parsed)
+	}
+	if spider.jobs != 1 {
+		t.Errorf("%d jobs were finished, 1 expected", spider.jobs)
+	}
+	if m.errors != 1 {
+		t.Errorf("%d callback errors were handled, 1 expected", m.errors)
+	}
+}
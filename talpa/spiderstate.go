@@ -0,0 +1,171 @@
+package talpa
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 单个爬虫的运行状态, 在 NewCrawler 中为每个爬虫创建, 之后不会增减
+type spiderState struct {
+	spider Spider
+	// 同时在途的请求数量上限, 为 0 时不限制
+	quota    int64
+	inflight int64
+	sent     int64
+	// 在途请求中回调正在等待请求队列空间的数量, 这些请求不占用并发配额
+	waiting int64
+	// 两次分发请求之间的间隔, 以及下一个请求最早的分发时间, 单位为纳秒
+	delay time.Duration
+	next  int64
+	// 爬虫是否已经发出 SpiderClosed 信号, 使用原子操作保证 SpiderOpened 和 SpiderClosed 成对发出
+	closed int32
+	// 保证同一个爬虫的空闲检查不会同时进行
+	mu sync.Mutex
+}
+
+// 爬虫的运行状态, 用于监控多个爬虫的进度
+type SpiderStatus struct {
+	Name string `json:"name"`
+	// 队列中等待的请求数量, 请求调度器不是 SpiderScheduler 时为 -1
+	Queued   int64 `json:"queued"`
+	Inflight int64 `json:"inflight"`
+	Sent     int64 `json:"sent"`
+	Closed   bool  `json:"closed"`
+}
+
+func newSpiderStates(spiders []Spider) map[Spider]*spiderState {
+	states := make(map[Spider]*spiderState, len(spiders))
+	for _, s := range spiders {
+		state := &spiderState{spider: s}
+		if fs, ok := s.(FairSpider); ok && fs.Concurrency() > 0 {
+			state.quota = int64(fs.Concurrency())
+		}
+		if ds, ok := s.(DelayedSpider); ok && ds.DownloadDelay() > 0 {
+			state.delay = ds.DownloadDelay()
+		}
+		states[s] = state
+	}
+	return states
+}
+
+// 爬虫的在途请求是否没有达到并发配额并且已经过了请求间隔, 不属于任何爬虫的请求不受限制
+func (c *Crawler) spiderAvailable(s Spider) bool {
+	state, ok := c.spiderStates[s]
+	if !ok {
+		return true
+	}
+	if state.delay > 0 && time.Now().UnixNano() < atomic.LoadInt64(&state.next) {
+		return false
+	}
+	if state.quota <= 0 {
+		return true
+	}
+	// 先读取在途请求数量, 两次读取之间回调结束等待时只会少分发请求, 不会超过配额
+	inflight := atomic.LoadInt64(&state.inflight)
+	return inflight-atomic.LoadInt64(&state.waiting) < state.quota
+}
+
+// 爬虫的等待计数, 用于 queueBound.put, 不属于任何爬虫时返回 nil
+func (c *Crawler) spiderWaiting(s Spider) *int64 {
+	if state, ok := c.spiderStates[s]; ok {
+		return &state.waiting
+	}
+	return nil
+}
+
+// 请求分发时调用
+func (c *Crawler) spiderSent(s Spider) {
+	if state, ok := c.spiderStates[s]; ok {
+		atomic.AddInt64(&state.inflight, 1)
+		atomic.AddInt64(&state.sent, 1)
+		if state.delay > 0 {
+			atomic.StoreInt64(&state.next, time.Now().Add(state.delay).UnixNano())
+		}
+	}
+}
+
+// 有请求的爬虫都在等待请求间隔时, 返回在最早可以分发请求时触发的通道, 否则返回 nil
+func (c *Crawler) spiderDelayTimer() <-chan time.Time {
+	if c.spiderScheduler == nil {
+		return nil
+	}
+	var wait time.Duration
+	now := time.Now().UnixNano()
+	for _, state := range c.spiderStates {
+		if state.delay <= 0 || c.spiderScheduler.LenOf(state.spider) == 0 {
+			continue
+		}
+		d := time.Duration(atomic.LoadInt64(&state.next) - now)
+		if d <= 0 {
+			return nil
+		}
+		if wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	if wait == 0 {
+		return nil
+	}
+	return time.After(wait)
+}
+
+// 请求及其回调处理完成时调用. 使用 SpiderScheduler 时可以知道每个爬虫的队列是否为空,
+// 爬虫没有在途请求并且队列为空时向爬虫获取新的请求, 仍然没有请求时发出 SpiderClosed 信号
+func (c *Crawler) spiderDone(s Spider) {
+	state, ok := c.spiderStates[s]
+	if !ok {
+		return
+	}
+	if atomic.AddInt64(&state.inflight, -1) > 0 || c.spiderScheduler == nil {
+		return
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if atomic.LoadInt64(&state.inflight) > 0 || c.spiderScheduler.LenOf(s) > 0 {
+		return
+	}
+	// 正在退出时不再获取新的请求
+	if c.ctx.Err() == nil {
+		c.spiderIdle(s)
+		if c.spiderScheduler.LenOf(s) > 0 {
+			return
+		}
+	}
+	c.closeSpider(state)
+}
+
+func (c *Crawler) closeSpider(state *spiderState) {
+	if atomic.CompareAndSwapInt32(&state.closed, 0, 1) {
+		c.logger.WithField("Spider", SpiderName(state.spider)).Infoln("Spider closed")
+		c.emit(Event{Signal: SpiderClosed, Spider: state.spider})
+	}
+}
+
+// 已经关闭的爬虫有新的请求入队时重新打开
+func (c *Crawler) reopenSpider(s Spider) {
+	state, ok := c.spiderStates[s]
+	if ok && atomic.CompareAndSwapInt32(&state.closed, 1, 0) {
+		c.logger.WithField("Spider", SpiderName(s)).Infoln("Spider reopened")
+		c.emit(Event{Signal: SpiderOpened, Spider: s})
+	}
+}
+
+// 每个爬虫当前的运行状态, 顺序与创建 Crawler 时的爬虫顺序一致, 可以在运行过程中调用
+func (c *Crawler) SpiderStatus() []SpiderStatus {
+	status := make([]SpiderStatus, len(c.spiders))
+	for i, s := range c.spiders {
+		state := c.spiderStates[s]
+		status[i] = SpiderStatus{
+			Name:     SpiderName(s),
+			Queued:   -1,
+			Inflight: atomic.LoadInt64(&state.inflight),
+			Sent:     atomic.LoadInt64(&state.sent),
+			Closed:   atomic.LoadInt32(&state.closed) == 1,
+		}
+		if c.spiderScheduler != nil {
+			status[i].Queued = c.spiderScheduler.LenOf(s)
+		}
+	}
+	return status
+}
@@ -0,0 +1,200 @@
+package talpa
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+type spillRequestScheduler struct {
+	// 内存中的调度器, 最多保存 capacity 个请求
+	RequestScheduler
+	*requestCodec
+	capacity int64
+	dir      string
+
+	mu sync.Mutex
+	// 磁盘中第一个请求和下一个请求的序号, 磁盘中的请求按入队顺序取回
+	head, tail int64
+	// 每个爬虫在磁盘中的请求数量, 以及磁盘中每个请求所属的爬虫, 请求不能取回时也需要减少计数
+	spilled map[Spider]int64
+	owners  map[int64]Spider
+
+	logger *logrus.Entry
+}
+
+var _ RequestScheduler = (*spillRequestScheduler)(nil)
+
+func (rs *spillRequestScheduler) file(seq int64) string {
+	return path.Join(rs.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+// 在磁盘中保存请求, 请求不能持久化时返回错误
+func (rs *spillRequestScheduler) spill(req *gen.Request) error {
+	dr, err := newDiskRequest(req)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(dr)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(rs.file(rs.tail), data, 0644); err != nil {
+		return err
+	}
+	s := spiderOf(req)
+	rs.owners[rs.tail] = s
+	rs.spilled[s]++
+	rs.tail++
+	return nil
+}
+
+// 从磁盘中取回请求放入内存, 直到内存中的请求达到容量. 需要持有锁
+func (rs *spillRequestScheduler) refill() {
+	n := rs.capacity - rs.RequestScheduler.Len()
+	if n <= 0 || rs.head == rs.tail {
+		return
+	}
+	reqs := make([]*gen.Request, 0, n)
+	for ; rs.head < rs.tail && int64(len(reqs)) < n; rs.head++ {
+		name := rs.file(rs.head)
+		s := rs.owners[rs.head]
+		delete(rs.owners, rs.head)
+		rs.spilled[s]--
+		data, err := ioutil.ReadFile(name)
+		if err == nil {
+			dr := new(diskRequest)
+			if err = json.Unmarshal(data, dr); err == nil {
+				var req *gen.Request
+				if req, err = rs.restore(dr); err == nil {
+					reqs = append(reqs, req)
+				}
+			}
+		}
+		if err != nil {
+			// 请求在保存时已经检查过, 只有文件被外部修改时才会出错
+			rs.logger.WithFields(logrus.Fields{"File": name, "Spider": SpiderName(s), "Error": err}).Errorln("Spilled request was lost")
+		}
+		os.Remove(name)
+	}
+	if len(reqs) > 0 {
+		rs.RequestScheduler.Put(reqs...)
+	}
+}
+
+// 内存中的请求达到容量或者磁盘中已经有请求时, 新的请求保存到磁盘中, 保证磁盘中的请求先于之后的请求被取回
+func (rs *spillRequestScheduler) Put(reqs ...*gen.Request) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	free := rs.capacity - rs.RequestScheduler.Len()
+	mem := make([]*gen.Request, 0, len(reqs))
+	for _, req := range reqs {
+		if req == nil {
+			rs.logger.Panicln("Cann't push a nil request into queue!")
+		}
+		if rs.head == rs.tail && int64(len(mem)) < free {
+			mem = append(mem, req)
+			continue
+		}
+		if err := rs.spill(req); err != nil {
+			// 回调不是爬虫方法的请求不能保存到磁盘, 只能留在内存中
+			rs.logger.WithField("Error", err).Warnln("Request was not spilled")
+			mem = append(mem, req)
+		}
+	}
+	if len(mem) > 0 {
+		rs.RequestScheduler.Put(mem...)
+	}
+}
+func (rs *spillRequestScheduler) Get(number int64) []*gen.Request {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.refill()
+	return rs.RequestScheduler.Get(number)
+}
+func (rs *spillRequestScheduler) Len() int64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.RequestScheduler.Len() + rs.tail - rs.head
+}
+func (rs *spillRequestScheduler) Empty() bool {
+	return rs.Len() == 0
+}
+func (rs *spillRequestScheduler) Unwrap() RequestScheduler {
+	return rs.RequestScheduler
+}
+
+// 磁盘中的请求只用于限制内存, 释放调度器时删除
+func (rs *spillRequestScheduler) Dispose() {
+	rs.RequestScheduler.Dispose()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for ; rs.head < rs.tail; rs.head++ {
+		os.Remove(rs.file(rs.head))
+	}
+	rs.spilled = make(map[Spider]int64)
+	rs.owners = make(map[int64]Spider)
+}
+
+// 被包装的调度器中有 SpiderScheduler 时同样按爬虫取出请求
+type spillSpiderScheduler struct {
+	*spillRequestScheduler
+	ss SpiderScheduler
+}
+
+var _ SpiderScheduler = (*spillSpiderScheduler)(nil)
+
+func (rs *spillSpiderScheduler) GetFrom(allow func(Spider) bool) *gen.Request {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.refill()
+	return rs.ss.GetFrom(allow)
+}
+func (rs *spillSpiderScheduler) LenOf(s Spider) int64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.ss.LenOf(s) + rs.spilled[s]
+}
+
+// 限制内存中请求数量的调度器, rs 中的请求达到 capacity 后新的请求保存到 dir 目录下, rs 有空间时按入队顺序取回.
+// 保存到磁盘中的请求与 NewDiskRequestScheduler 一样需要回调是爬虫的方法, 不满足的请求仍然放入内存,
+// 取回的请求通过 base.Clone() 生成, 回调从 spiders 中同名的爬虫得到. 磁盘中的请求在释放调度器时删除, 不能用于恢复抓取.
+// 取回的请求会再次放入 rs, 去重需要在外层使用 NewDupeFilterScheduler 包装这个调度器
+func NewSpillRequestScheduler(rs RequestScheduler, capacity int64, dir string, base *gen.Request, spiders ...Spider) (RequestScheduler, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("talpa: invalid capacity %d", capacity)
+	}
+	dir = path.Join(dir, "spill")
+	// 上次运行留下的请求已经失去意义
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	rc, err := newRequestCodec(base, spiders)
+	if err != nil {
+		return nil, err
+	}
+	srs := &spillRequestScheduler{
+		RequestScheduler: rs,
+		requestCodec:     rc,
+		capacity:         capacity,
+		dir:              dir,
+		spilled:          make(map[Spider]int64),
+		owners:           make(map[int64]Spider),
+	}
+	srs.logger = Logger.WithField("RequestScheduler", fmt.Sprintf("%p", srs))
+	srs.logger.WithFields(logrus.Fields{"Dir": dir, "Capacity": capacity}).Infoln("Spill directory created")
+	// Crawler 直接从 SpiderScheduler 中取出请求, 需要在取出前从磁盘中取回请求
+	if ss, ok := spiderSchedulerOf(rs); ok {
+		return &spillSpiderScheduler{spillRequestScheduler: srs, ss: ss}, nil
+	}
+	return srs, nil
+}
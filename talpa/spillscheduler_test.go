@@ -0,0 +1,112 @@
+package talpa
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+func TestSpillRequestScheduler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spiders := []Spider{&namedSpider{"a"}, &namedSpider{"b"}}
+	rs, err := NewSpillRequestScheduler(NewFairRequestScheduler(10), 3, dir, gen.NewRequest(), spiders...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, ok := spiderSchedulerOf(rs)
+	if !ok || ss != rs {
+		t.Fatal("Spill scheduler should be used as the SpiderScheduler")
+	}
+	newRequest := func(s Spider, i int) *gen.Request {
+		req := gen.NewRequest().URL("http://www.example.com/?id=" + strconv.Itoa(i))
+		meta := MetaOf(req)
+		meta.Spider = s
+		meta.CallBack = s.(*namedSpider).Parse
+		// 后入队的请求优先级更高, 但磁盘中的请求按入队顺序取回
+		meta.Priority = i
+		req.Context.Set("Endpoint", "test")
+		return req
+	}
+	for i := 0; i < 10; i++ {
+		rs.Put(newRequest(spiders[i%2], i))
+	}
+	// 回调不是爬虫方法的请求不能保存到磁盘, 留在内存中
+	closure := newRequest(spiders[0], 10)
+	MetaOf(closure).CallBack = func(*gen.Response, Helper) {}
+	rs.Put(closure)
+
+	files, _ := ioutil.ReadDir(path.Join(dir, "spill"))
+	if rs.Len() != 11 || len(files) != 7 {
+		t.Errorf("Len is %d with %d files, 11 requests with 7 files expected", rs.Len(), len(files))
+	}
+	if n := ss.LenOf(spiders[0]); n != 6 {
+		t.Errorf("Spider a has %d requests, 6 expected", n)
+	}
+
+	n := 0
+	for !rs.Empty() {
+		req := ss.GetFrom(nil)
+		if req == nil {
+			t.Fatal("No request was returned from a non-empty scheduler")
+		}
+		if req != closure && (MetaOf(req).CallBack == nil || Endpoint(req) != "test") {
+			t.Errorf("Request %d was not restored", MetaOf(req).Priority)
+		}
+		n++
+	}
+	if n != 11 {
+		t.Errorf("%d requests were returned, 11 expected", n)
+	}
+	if files, _ := ioutil.ReadDir(path.Join(dir, "spill")); len(files) != 0 {
+		t.Errorf("%d spilled files were left", len(files))
+	}
+	if n := ss.LenOf(spiders[0]); n != 0 {
+		t.Errorf("Spider a has %d requests, 0 expected", n)
+	}
+}
+
+// 磁盘中的请求不能取回时同样从爬虫的请求数量中减去
+func TestSpillRequestSchedulerLost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "talpa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spider := &namedSpider{"a"}
+	rs, err := NewSpillRequestScheduler(NewFairRequestScheduler(10), 1, dir, gen.NewRequest(), spider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, _ := spiderSchedulerOf(rs)
+	for i := 0; i < 3; i++ {
+		req := gen.NewRequest().URL("http://www.example.com/?id=" + strconv.Itoa(i))
+		MetaOf(req).Spider = spider
+		MetaOf(req).CallBack = spider.Parse
+		rs.Put(req)
+	}
+	files, _ := ioutil.ReadDir(path.Join(dir, "spill"))
+	if len(files) != 2 {
+		t.Fatalf("%d spilled files, 2 expected", len(files))
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "spill", files[0].Name()), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; !rs.Empty(); n++ {
+		if ss.GetFrom(nil) == nil || n > 3 {
+			t.Fatal("Requests were not drained")
+		}
+	}
+	if n := ss.LenOf(spider); n != 0 {
+		t.Errorf("Spider a has %d requests after a spilled request was lost, 0 expected", n)
+	}
+}
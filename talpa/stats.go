@@ -0,0 +1,144 @@
+package talpa
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 延迟采样的最大数量, 超过后使用蓄水池抽样保证内存占用固定
+const maxLatencySamples = 10000
+
+// Crawler 使用的统计键
+const (
+	StatsRequestScheduled = "request/scheduled"
+	StatsRequestSent      = "request/sent"
+	StatsRequestFailed    = "request/failed"
+	StatsRequestDropped   = "request/dropped"
+	StatsRequestDepth     = "request/depth"
+	StatsResponseBytes    = "response/bytes"
+	StatsRateLimitWait    = "ratelimit/wait_ms"
+	StatsItemScraped      = "item/scraped"
+	StatsItemDropped      = "item/dropped"
+	StatsItemFailed       = "item/failed"
+	StatsJobFinished      = "job/finished"
+	StatsCallbackError    = "error/callback"
+	StatsJobError         = "error/job"
+	StatsQueueRequest     = "queue/request"
+	StatsQueueJob         = "queue/job"
+	// 回调因为队列达到上限而等待的时间, 见 Crawler.SetQueueLimits
+	StatsBackpressureRequestWait = "backpressure/request/wait_ms"
+	StatsBackpressureJobWait     = "backpressure/job/wait_ms"
+)
+
+// 并发安全的统计收集, 计数器键名按 "分类/名称" 的方式组织, 如 "response/status/200"
+type Stats struct {
+	mu        sync.Mutex
+	counters  map[string]int64
+	maxValues map[string]int64
+	latencies []time.Duration
+	// 已经记录的延迟数量, 用于蓄水池抽样
+	numLatencies int64
+	startTime    time.Time
+	finishTime   time.Time
+}
+
+// 创建一个空的统计, Crawler 会自动创建自己的统计, 在 Crawler 之外执行回调时可以用于实现 Helper
+func NewStats() *Stats {
+	return &Stats{counters: make(map[string]int64), maxValues: make(map[string]int64)}
+}
+
+// 增加计数器的值
+func (s *Stats) Inc(key string, n int64) {
+	s.mu.Lock()
+	s.counters[key] += n
+	s.mu.Unlock()
+}
+
+// 记录最大值, 如队列长度的高水位
+func (s *Stats) Max(key string, v int64) {
+	s.mu.Lock()
+	if old, ok := s.maxValues[key]; !ok || v > old {
+		s.maxValues[key] = v
+	}
+	s.mu.Unlock()
+}
+
+// 记录一次请求的延迟
+func (s *Stats) Latency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.numLatencies++
+	if len(s.latencies) < maxLatencySamples {
+		s.latencies = append(s.latencies, d)
+	} else if i := rand.Int63n(s.numLatencies); i < maxLatencySamples {
+		s.latencies[i] = d
+	}
+}
+
+func (s *Stats) start() {
+	s.mu.Lock()
+	s.startTime = time.Now()
+	s.mu.Unlock()
+}
+func (s *Stats) finish() {
+	s.mu.Lock()
+	if s.finishTime.IsZero() {
+		s.finishTime = time.Now()
+	}
+	s.mu.Unlock()
+}
+
+// 延迟的百分位数
+type LatencyPercentiles struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+// 某一时刻的统计快照, 可以直接序列化为 JSON
+type StatsSnapshot struct {
+	Counters  map[string]int64   `json:"counters"`
+	MaxValues map[string]int64   `json:"max_values"`
+	Latency   LatencyPercentiles `json:"latency"`
+	StartTime time.Time          `json:"start_time"`
+	// 爬虫还在运行时为零值
+	FinishTime time.Time     `json:"finish_time"`
+	Elapsed    time.Duration `json:"elapsed"`
+}
+
+func (s *Stats) Snapshot() StatsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := StatsSnapshot{
+		Counters:   make(map[string]int64, len(s.counters)),
+		MaxValues:  make(map[string]int64, len(s.maxValues)),
+		StartTime:  s.startTime,
+		FinishTime: s.finishTime,
+	}
+	for k, v := range s.counters {
+		snapshot.Counters[k] = v
+	}
+	for k, v := range s.maxValues {
+		snapshot.MaxValues[k] = v
+	}
+	switch {
+	case s.startTime.IsZero():
+	case s.finishTime.IsZero():
+		snapshot.Elapsed = time.Since(s.startTime)
+	default:
+		snapshot.Elapsed = s.finishTime.Sub(s.startTime)
+	}
+	if n := len(s.latencies); n > 0 {
+		sorted := make([]time.Duration, n)
+		copy(sorted, s.latencies)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		percentile := func(p int) time.Duration {
+			return sorted[(n-1)*p/100]
+		}
+		snapshot.Latency = LatencyPercentiles{P50: percentile(50), P90: percentile(90), P99: percentile(99), Max: sorted[n-1]}
+	}
+	return snapshot
+}
@@ -0,0 +1,58 @@
+package talpa
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStatsPercentiles(t *testing.T) {
+	s := NewStats()
+	for i := 1; i <= 100; i++ {
+		s.Latency(time.Duration(i) * time.Millisecond)
+	}
+	s.Max("queue", 3)
+	s.Max("queue", 1)
+	snapshot := s.Snapshot()
+	expected := LatencyPercentiles{P50: 50 * time.Millisecond, P90: 90 * time.Millisecond, P99: 99 * time.Millisecond, Max: 100 * time.Millisecond}
+	if snapshot.Latency != expected {
+		t.Errorf("Latency is %+v, %+v expected", snapshot.Latency, expected)
+	}
+	if snapshot.MaxValues["queue"] != 3 {
+		t.Errorf("Max value is %d, 3 expected", snapshot.MaxValues["queue"])
+	}
+}
+
+func TestCrawlerStats(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	spider := &itemSpider{url: ts.URL, num: 6}
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), NewDownloader(2), NewJobScheduler(10), NewScraper(2))
+	crawler.UsePipeline(new(filterPipeline))
+	crawler.Run(context.Background())
+
+	snapshot := crawler.Stats()
+	expected := map[string]int64{
+		StatsRequestScheduled:     6,
+		StatsRequestSent:          6,
+		"response/status/200":     6,
+		StatsResponseBytes:        12,
+		StatsItemScraped:          2,
+		StatsItemScraped + "/int": 2,
+		StatsItemDropped:          3,
+		StatsItemFailed:           1,
+		StatsJobFinished:          6,
+	}
+	for key, v := range expected {
+		if snapshot.Counters[key] != v {
+			t.Errorf("%s is %d, %d expected", key, snapshot.Counters[key], v)
+		}
+	}
+	if snapshot.MaxValues[StatsQueueRequest] != 6 {
+		t.Errorf("Request queue high-water mark is %d, 6 expected", snapshot.MaxValues[StatsQueueRequest])
+	}
+	if snapshot.Latency.Max == 0 || snapshot.FinishTime.IsZero() || snapshot.Elapsed == 0 {
+		t.Errorf("Latency or elapsed time was not recorded: %+v", snapshot)
+	}
+}
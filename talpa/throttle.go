@@ -0,0 +1,162 @@
+package talpa
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 下载器配置
+type DownloaderOptions struct {
+	// 下载器的总并发数, 必须为正整数
+	Concurrency int
+	// 运行时通过 ResizableDownloader 可以调整到的最大并发数, 小于 Concurrency 时为 Concurrency
+	MaxConcurrency int
+	// 同一主机的最大并发数, 为 0 表示不限制
+	ConcurrencyPerHost int
+	// 同一主机两次请求之间的间隔, 开启自动限速时作为最小间隔
+	Delay time.Duration
+	// 为请求间隔加上随机抖动, 实际间隔为 0.5 到 1.5 倍的 Delay
+	RandomizeDelay bool
+	// 根据响应延迟和错误情况自动调整请求间隔
+	AutoThrottle bool
+	// 自动限速时的最大请求间隔
+	AutoThrottleMaxDelay time.Duration
+	// 自动限速时期望的同一主机的平均并发请求数, 值越大请求间隔越小
+	AutoThrottleTargetConcurrency float64
+	// 按接口的令牌桶限速, 键为请求的接口类别(见 Endpoint)或者 "主机/路径"
+	RateLimits map[string]RateLimit
+}
+
+// 每个主机的限速状态
+type hostSlot struct {
+	// 限制同一主机的并发, 为 nil 时不限制
+	sem chan struct{}
+
+	mu    sync.Mutex
+	delay time.Duration
+	// 下一个请求最早的发送时间
+	next time.Time
+}
+
+// 按主机进行并发限制和限速
+type throttle struct {
+	opts DownloaderOptions
+
+	mu    sync.Mutex
+	slots map[string]*hostSlot
+}
+
+func newThrottle(opts DownloaderOptions) *throttle {
+	if opts.AutoThrottleTargetConcurrency <= 0 {
+		opts.AutoThrottleTargetConcurrency = 1
+	}
+	if opts.AutoThrottleMaxDelay < opts.Delay {
+		opts.AutoThrottleMaxDelay = opts.Delay
+	}
+	return &throttle{opts: opts, slots: make(map[string]*hostSlot)}
+}
+
+// 没有任何限制时不需要计算请求的主机
+func (t *throttle) disabled() bool {
+	return t.opts.ConcurrencyPerHost <= 0 && t.opts.Delay <= 0 && !t.opts.AutoThrottle
+}
+
+func (t *throttle) slot(host string) *hostSlot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.slots[host]
+	if !ok {
+		s = &hostSlot{delay: t.opts.Delay}
+		if t.opts.ConcurrencyPerHost > 0 {
+			s.sem = make(chan struct{}, t.opts.ConcurrencyPerHost)
+		}
+		t.slots[host] = s
+	}
+	return s
+}
+
+// 等待直到请求可以发送, 需要等待时先调用 onWait, 返回的 hostSlot 需要在请求完成后释放
+func (t *throttle) acquire(req *gen.Request, onWait func()) *hostSlot {
+	if t.disabled() {
+		return nil
+	}
+	raw, err := RawRequest(req)
+	if err != nil {
+		// 请求本身有错误, 发送时会交给 ErrBack 处理
+		return nil
+	}
+	s := t.slot(raw.URL.Host)
+	if s.sem != nil {
+		select {
+		case s.sem <- struct{}{}:
+		default:
+			onWait()
+			s.sem <- struct{}{}
+		}
+	}
+	// 预约下一个发送时间, 同一主机的请求按间隔依次发送
+	s.mu.Lock()
+	now := time.Now()
+	wait := s.next.Sub(now)
+	if wait < 0 {
+		wait = 0
+	}
+	delay := s.delay
+	if t.opts.RandomizeDelay && delay > 0 {
+		delay = time.Duration((0.5 + rand.Float64()) * float64(delay))
+	}
+	s.next = now.Add(wait + delay)
+	s.mu.Unlock()
+	if wait > 0 {
+		onWait()
+		time.Sleep(wait)
+	}
+	return s
+}
+
+// 释放请求占用的并发, 开启自动限速时根据响应调整请求间隔
+func (t *throttle) release(s *hostSlot, latency time.Duration, res *gen.Response, err error) {
+	if s == nil {
+		return
+	}
+	if s.sem != nil {
+		<-s.sem
+	}
+	if !t.opts.AutoThrottle {
+		return
+	}
+	failed := err != nil || res == nil || res.StatusCode >= http.StatusInternalServerError || res.StatusCode == http.StatusTooManyRequests
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// 期望的间隔是在响应延迟内同时处理 AutoThrottleTargetConcurrency 个请求, 逐步向期望值靠拢
+	target := time.Duration(float64(latency) / t.opts.AutoThrottleTargetConcurrency)
+	delay := (s.delay + target) / 2
+	if failed {
+		// 出错时只增加间隔, 成倍增加使错误较多时迅速降低请求频率
+		if d := s.delay * 2; d > delay {
+			delay = d
+		}
+		if target > delay {
+			delay = target
+		}
+	}
+	if delay < t.opts.Delay {
+		delay = t.opts.Delay
+	}
+	if delay > t.opts.AutoThrottleMaxDelay {
+		delay = t.opts.AutoThrottleMaxDelay
+	}
+	s.delay = delay
+}
+
+// 主机当前的请求间隔
+func (t *throttle) delayOf(host string) time.Duration {
+	s := t.slot(host)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delay
+}
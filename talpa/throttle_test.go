@@ -0,0 +1,154 @@
+package talpa
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 并发地通过 throttle 发送请求
+func throttledFetch(th *throttle, urlStr string, num int) {
+	var wg sync.WaitGroup
+	for i := 0; i < num; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := gen.NewRequest().URL(urlStr)
+			slot := th.acquire(req, func() {})
+			start := time.Now()
+			res, err := req.Do()
+			th.release(slot, time.Since(start), res, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestThrottleConcurrencyPerHost(t *testing.T) {
+	var current, max int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&current, 1)
+		defer atomic.AddInt32(&current, -1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	throttledFetch(newThrottle(DownloaderOptions{ConcurrencyPerHost: 2}), ts.URL, 10)
+	if max != 2 {
+		t.Errorf("Max concurrency is %d, 2 expected", max)
+	}
+}
+
+func TestThrottleDelay(t *testing.T) {
+	ts := newTestServer(0)
+	defer ts.Close()
+
+	start := time.Now()
+	throttledFetch(newThrottle(DownloaderOptions{Delay: 20 * time.Millisecond, RandomizeDelay: true}), ts.URL, 5)
+	// 第一个请求立即发送, 之后每个请求至少间隔 0.5 倍的 Delay
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("5 requests were sent in %s", elapsed)
+	}
+}
+
+func TestAutoThrottle(t *testing.T) {
+	var fail int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	th := newThrottle(DownloaderOptions{AutoThrottle: true, AutoThrottleMaxDelay: time.Second})
+	throttledFetch(th, ts.URL, 1)
+	// 延迟为 20ms, 期望并发为 1 时间隔逐步向 20ms 靠拢
+	delay := th.delayOf(u.Host)
+	if delay < 10*time.Millisecond || delay > 20*time.Millisecond {
+		t.Errorf("Delay is %s after a slow response", delay)
+	}
+	atomic.StoreInt32(&fail, 1)
+	throttledFetch(th, ts.URL, 1)
+	if d := th.delayOf(u.Host); d < 2*delay {
+		t.Errorf("Delay is %s after a failed response, at least %s expected", d, 2*delay)
+	}
+}
+
+// 初始请求都发往慢主机, 快主机的请求在运行中添加
+type twoHostSpider struct {
+	slow, fast         string
+	numSlow, numFast   int
+	slowParsed         int32
+	slowParsedWhenFast int32
+	fastParsed         int32
+}
+
+func (s *twoHostSpider) StartRequests() []*gen.Request {
+	reqs := make([]*gen.Request, s.numSlow)
+	for i := range reqs {
+		reqs[i] = gen.NewRequest().URL(s.slow)
+		MetaOf(reqs[i]).CallBack = s.ParseSlow
+	}
+	return reqs
+}
+func (s *twoHostSpider) fastRequests() []*gen.Request {
+	reqs := make([]*gen.Request, s.numFast)
+	for i := range reqs {
+		reqs[i] = gen.NewRequest().URL(s.fast)
+		MetaOf(reqs[i]).CallBack = s.ParseFast
+	}
+	return reqs
+}
+func (s *twoHostSpider) ParseSlow(res *gen.Response, h Helper) {
+	atomic.AddInt32(&s.slowParsed, 1)
+}
+func (s *twoHostSpider) ParseFast(res *gen.Response, h Helper) {
+	if int(atomic.AddInt32(&s.fastParsed, 1)) == s.numFast {
+		atomic.StoreInt32(&s.slowParsedWhenFast, atomic.LoadInt32(&s.slowParsed))
+	}
+}
+
+func TestCrawlerThrottledHost(t *testing.T) {
+	slow := newTestServer(20 * time.Millisecond)
+	defer slow.Close()
+	fast := newTestServer(0)
+	defer fast.Close()
+
+	// 慢主机同时只能有一个请求, 等待的请求不能占满并发阻塞快主机的请求
+	spider := &twoHostSpider{slow: slow.URL, fast: fast.URL, numSlow: 10, numFast: 2}
+	d := NewDownloaderWithOptions(DownloaderOptions{Concurrency: 2, ConcurrencyPerHost: 1})
+	crawler := NewCrawler([]Spider{spider}, NewRequestScheduler(10), d, nil, nil)
+	crawler.Start()
+	// 等待限速的请求不计入并发, 慢主机的请求全部被分发
+	deadline := time.Now().Add(5 * time.Second)
+	for !crawler.requestScheduler.Empty() || d.(ThrottledDownloader).NumThrottled() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests are still queued, %d are throttled", crawler.requestScheduler.Len(), d.(ThrottledDownloader).NumThrottled())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := crawler.PutRequest(spider, spider.fastRequests()...); err != nil {
+		t.Fatal(err)
+	}
+	crawler.Wait()
+	if spider.slowParsed != 10 || spider.fastParsed != 2 {
+		t.Fatalf("slow=%d fast=%d responses were parsed", spider.slowParsed, spider.fastParsed)
+	}
+	if spider.slowParsedWhenFast > 5 {
+		t.Errorf("%d slow responses were parsed before the fast host finished", spider.slowParsedWhenFast)
+	}
+}
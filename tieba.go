@@ -1,6 +1,16 @@
 package tgod
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/go-tgod/tgod/talpa"
 	"github.com/go-tgod/tgod/tieba"
@@ -8,9 +18,75 @@ import (
 	gen "gopkg.in/h2non/gentleman.v2"
 )
 
+// 判断贴吧接口的响应是否返回了 codes 中的错误码
+func TiebaErrorCode(codes ...int) func(*gen.Response) bool {
+	matched := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		matched[code] = true
+	}
+	return func(res *gen.Response) bool {
+		if len(matched) == 0 {
+			return false
+		}
+		// 使用 Bytes 解析不会消耗响应内容, 回调中仍然可以解析响应
+		var status tieba.ResponseStatus
+		if err := json.Unmarshal(res.Bytes(), &status); err != nil {
+			return false
+		}
+		return matched[status.ErrorCode]
+	}
+}
+
+// 判断贴吧接口的响应是否需要重试, 除了服务器错误外, 返回 codes 中的错误码时也会重试
+func TiebaRetryResponse(codes ...int) func(*gen.Response) bool {
+	errorCode := TiebaErrorCode(codes...)
+	return func(res *gen.Response) bool {
+		return talpa.DefaultRetryResponse(res) || errorCode(res)
+	}
+}
+
+// 判断贴吧接口的响应是否可以写入 HTTP 缓存, 返回错误码的响应不缓存, 以免之后一直读到缓存的错误
+func TiebaCacheableResponse(res *gen.Response) bool {
+	var status tieba.ResponseStatus
+	if err := json.Unmarshal(res.Bytes(), &status); err != nil {
+		return false
+	}
+	return status.ErrorCode == 0
+}
+
+// 判断代理是否被贴吧限制, 返回 403 或者 codes 中的错误码时禁用代理
+func TiebaBanResponse(codes ...int) func(*gen.Response) bool {
+	errorCode := TiebaErrorCode(codes...)
+	return func(res *gen.Response) bool {
+		return res.StatusCode == http.StatusForbidden || errorCode(res)
+	}
+}
+
+// 按错误码统计贴吧接口返回的错误
+func countErrorCode(helper talpa.Helper, status tieba.ResponseStatus) {
+	helper.Stats().Inc(fmt.Sprintf("tieba/error_code/%d", status.ErrorCode), 1)
+}
+
+// 使用 SpiderSettings(forum) 中的配置创建贴吧爬虫
 func NewTiebaSpider(forum string) *TiebaSpider {
+	return NewTiebaSpiderWithSettings(forum, SpiderSettings(forum))
+}
+
+func NewTiebaSpiderWithSettings(forum string, settings *viper.Viper) *TiebaSpider {
 	spider := new(TiebaSpider)
 	spider.forum = forum
+	// 从调度器中恢复抓取时不会调用 StartRequests, 配置需要在这里读取
+	spider.tlrn = settings.GetInt("threadPaginate")
+	spider.plrn = settings.GetInt("postPaginate")
+	spider.withSubPost = settings.GetBool("fetchSubPosts")
+	spider.maxPages = settings.GetInt("maxPagesPerThread")
+	spider.priority = settings.GetInt("priority")
+	spider.weight = settings.GetInt("spiderWeight")
+	spider.concurrency = settings.GetInt("spiderConcurrency")
+	spider.delay = settings.GetDuration("downloadDelay")
+	spider.pollInterval = settings.GetDuration("forumPollInterval")
+	spider.threads = make(map[string]time.Time)
+	spider.fetching = make(map[string]*threadFetch)
 	spider.logger = Logger.WithField("TiebaSpider", forum)
 	return spider
 }
@@ -20,48 +96,225 @@ type TiebaSpider struct {
 	logger *logrus.Entry
 	tlrn   int
 	plrn   int
+	// 是否带上楼中楼, 以及每个帖子最多抓取的回帖页数
+	withSubPost bool
+	maxPages    int
+	// 请求的基础优先级
+	priority int
+	// 公平调度的权重和并发配额, 以及两次请求之间的间隔
+	weight      int
+	concurrency int
+	delay       time.Duration
+	// 最后一次成功解析帖子列表和回帖列表的时间, 单位为纳秒
+	lastThreadList int64
+	lastPostList   int64
+	// 保持运行时重新获取第一页帖子列表的间隔, 为 0 时不重新获取
+	pollInterval time.Duration
+	lastPoll     int64
+	// 已经抓取完成的帖子的最后回复时间, 重新获取帖子列表时跳过没有更新的帖子
+	mu      sync.Mutex
+	threads map[string]time.Time
+	// 正在抓取的帖子, 所有回帖页都解析成功后才记录到 threads 中
+	fetching map[string]*threadFetch
 }
 
-var _ talpa.Spider = (*TiebaSpider)(nil)
+// 正在抓取的帖子的状态
+type threadFetch struct {
+	// 帖子列表中的最后回复时间
+	last time.Time
+	// 是否为有更新或者上次没有抓取完成的帖子, 重新抓取时回帖页需要跳过去重
+	refetch bool
+	// 还没有解析成功的回帖页数, 第一页解析之前为 -1
+	remaining int
+}
+
+var (
+	_ talpa.NamedSpider      = (*TiebaSpider)(nil)
+	_ talpa.IdleSpider       = (*TiebaSpider)(nil)
+	_ talpa.FairSpider       = (*TiebaSpider)(nil)
+	_ talpa.DelayedSpider    = (*TiebaSpider)(nil)
+	_ talpa.MetricsCollector = (*TiebaSpider)(nil)
+	_ talpa.AdhocSpider      = (*TiebaSpider)(nil)
+)
+
+// 导出贴吧最后一次抓取的时间, 用于监控抓取是否停滞
+func (t *TiebaSpider) CollectMetrics() []talpa.Metric {
+	timestamp := func(name, help string, addr *int64) talpa.Metric {
+		return talpa.Metric{
+			Name:   name,
+			Help:   help,
+			Type:   talpa.MetricGauge,
+			Labels: map[string]string{"forum": t.forum},
+			Value:  float64(atomic.LoadInt64(addr)) / float64(time.Second),
+		}
+	}
+	return []talpa.Metric{
+		timestamp("tgod_forum_last_thread_list_timestamp_seconds", "Unix time of the last parsed thread list of the forum.", &t.lastThreadList),
+		timestamp("tgod_forum_last_post_list_timestamp_seconds", "Unix time of the last parsed post list of the forum.", &t.lastPostList),
+	}
+}
+
+// 使用贴吧名作为爬虫名称
+func (t *TiebaSpider) Name() string {
+	return t.forum
+}
+
+func (t *TiebaSpider) Weight() int {
+	return t.weight
+}
+func (t *TiebaSpider) Concurrency() int {
+	return t.concurrency
+}
+func (t *TiebaSpider) DownloadDelay() time.Duration {
+	return t.delay
+}
+
+// 设置请求的回调和贴吧的优先级
+func (t *TiebaSpider) prepare(req *gen.Request, callBack func(*gen.Response, talpa.Helper)) *talpa.RequestMeta {
+	meta := talpa.MetaOf(req)
+	meta.CallBack = callBack
+	meta.Priority = t.priority
+	return meta
+}
+
+// 管理接口添加的请求, kind 为 thread 时抓取帖子 id 的第 page 页回帖, 第一页会继续抓取后续的页;
+// kind 为 forum 时抓取第 page 页帖子列表. page 默认为 1, 请求会跳过去重
+func (t *TiebaSpider) AdhocRequest(kind string, params url.Values) (*gen.Request, error) {
+	page := 1
+	if p := params.Get("page"); p != "" {
+		var err error
+		if page, err = strconv.Atoi(p); err != nil || page < 1 {
+			return nil, fmt.Errorf("invalid page %q", p)
+		}
+	}
+	var req *gen.Request
+	switch kind {
+	case "thread":
+		id := params.Get("id")
+		if id == "" {
+			return nil, errors.New("thread id is required")
+		}
+		req = tieba.PostListRequest(id, page, t.plrn, t.withSubPost)
+		if page == 1 {
+			t.prepare(req, t.ParsePostListPage)
+		} else {
+			t.prepare(req, t.ParsePostList)
+		}
+	case "forum":
+		req = tieba.ThreadListRequest(t.forum, page, t.tlrn)
+		t.prepare(req, t.ParseThreadList)
+	default:
+		return nil, fmt.Errorf("unknown request kind %q, thread or forum expected", kind)
+	}
+	talpa.MetaOf(req).DontFilter = true
+	return req, nil
+}
 
 // 初始请求, 获取置顶帖吧最新(第一页)帖子列表
 func (t *TiebaSpider) StartRequests() []*gen.Request {
-	t.tlrn = viper.GetInt("threadPaginate")
-	t.plrn = viper.GetInt("postPaginate")
-
+	atomic.StoreInt64(&t.lastPoll, time.Now().UnixNano())
 	req := tieba.ThreadListRequest(t.forum, 1, t.tlrn)
-	req.Context.Set("CallBack", t.ParseThreadList)
+	t.prepare(req, t.ParseThreadList)
 	return []*gen.Request{req}
 }
 
+// 距离上次获取帖子列表超过 pollInterval 时重新获取第一页帖子列表, 用于持续监控贴吧
+func (t *TiebaSpider) Idle() []*gen.Request {
+	if t.pollInterval <= 0 {
+		return nil
+	}
+	now := time.Now().UnixNano()
+	if time.Duration(now-atomic.LoadInt64(&t.lastPoll)) < t.pollInterval {
+		return nil
+	}
+	reqs := t.StartRequests()
+	// 同一页帖子列表的请求已经发送过, 需要跳过去重
+	talpa.MetaOf(reqs[0]).DontFilter = true
+	t.logger.Debugln("Forum was repolled")
+	return reqs
+}
+
+// 返回帖子是否抓取过以及是否在上次抓取后有更新, 有更新时开始抓取帖子.
+// 最后回复时间在所有回帖页解析成功后才记录, 抓取失败的帖子在下次获取帖子列表时会重新抓取
+func (t *TiebaSpider) threadUpdated(thread tieba.Thread) (seen, updated bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	last, seen := t.threads[thread.ID]
+	if seen && thread.LastTime.Equal(last) {
+		return true, false
+	}
+	// 上次没有抓取完成的帖子同样发送过请求
+	if _, ok := t.fetching[thread.ID]; ok {
+		seen = true
+	}
+	t.fetching[thread.ID] = &threadFetch{last: thread.LastTime.Time, refetch: seen, remaining: -1}
+	return seen, true
+}
+
+// 第一页回帖解析成功, pages 为还需要抓取的回帖页数, 返回后续页是否需要跳过去重.
+// 不是从帖子列表开始抓取的帖子不记录最后回复时间
+func (t *TiebaSpider) threadPagesStarted(id string, pages int) (refetch bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f, ok := t.fetching[id]
+	if !ok {
+		return false
+	}
+	f.remaining = pages
+	t.threadPageDone(id, f)
+	return f.refetch
+}
+
+// 后续的一页回帖解析成功
+func (t *TiebaSpider) threadPageParsed(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f, ok := t.fetching[id]; ok && f.remaining > 0 {
+		f.remaining--
+		t.threadPageDone(id, f)
+	}
+}
+
+// 所有回帖页都解析成功时记录帖子的最后回复时间, 需要持有锁
+func (t *TiebaSpider) threadPageDone(id string, f *threadFetch) {
+	if f.remaining == 0 {
+		t.threads[id] = f.last
+		delete(t.fetching, id)
+	}
+}
+
 // 解析帖子列表, 生成每个帖子回复列表第一页请求用于得到回帖页数进行下一步请求
 func (t *TiebaSpider) ParseThreadList(res *gen.Response, helper talpa.Helper) {
-	// 解析 json, 出错时会直接 panic 而不是返回 errCode
+	// 解析 json, 出错时直接 panic, 由 Crawler 作为回调错误记录并交给错误处理函数
 	entry := t.logger.WithField("CallBack", "ParseThreadList")
 	tlr := new(tieba.ThreadListResponse)
 	if err := res.JSON(tlr); err != nil {
 		t.logger.Panicln(err)
 	}
 	if err := tlr.CheckStatus(); err != nil {
-		entry.WithField("Error", err).Warnln("获取第一页帖子失败")
+		countErrorCode(helper, tlr.ResponseStatus)
+		entry.WithFields(logrus.Fields{"Error": err, "RetryTimes": talpa.RetryTimes(res.Context)}).Warnln("获取第一页帖子失败")
 		return
 	}
 
-	helper.PutJob(ForumUpsert(tlr.Forum))
-	if len(tlr.UserList) > 0 {
-		helper.PutJob(UserUpsert(tlr.UserList...))
-	}
-	// todo: 当帖子最后更新时间小于上一次最新帖子更新时间则跳过
+	atomic.StoreInt64(&t.lastThreadList, time.Now().UnixNano())
+	helper.PutItem(tlr.Forum)
+	putUsers(helper, tlr.UserList)
 
-	reqs := make([]*gen.Request, len(tlr.ThreadList))
-	entry.WithFields(logrus.Fields{"NumRequest": len(reqs)}).Debugln()
-	for i, thread := range tlr.ThreadList {
+	reqs := make([]*gen.Request, 0, len(tlr.ThreadList))
+	for _, thread := range tlr.ThreadList {
 		thread.ForumID = tlr.Forum.ID
-		helper.PutJob(ThreadUpsert(thread))
-		req := tieba.PostListRequest(thread.ID, 1, t.plrn, true)
-		req.Context.Set("CallBack", t.ParsePostListPage)
-		reqs[i] = req
+		helper.PutItem(thread)
+		// 跳过上次抓取后没有新回复的帖子, 有更新的帖子需要跳过去重重新抓取所有回帖
+		seen, updated := t.threadUpdated(thread)
+		if !updated {
+			continue
+		}
+		req := tieba.PostListRequest(thread.ID, 1, t.plrn, t.withSubPost)
+		t.prepare(req, t.ParsePostListPage).DontFilter = seen
+		reqs = append(reqs, req)
 	}
+	entry.WithFields(logrus.Fields{"NumRequest": len(reqs)}).Debugln()
 	helper.PutRequest(reqs...)
 }
 
@@ -71,7 +324,8 @@ func (t *TiebaSpider) handlePostList(entry *logrus.Entry, res *gen.Response, hel
 		panic(err)
 	}
 	if err := plr.CheckStatus(); err != nil {
-		entry.WithField("Error", err).Warnln("获取帖子楼层失败")
+		countErrorCode(helper, plr.ResponseStatus)
+		entry.WithFields(logrus.Fields{"Error": err, "RetryTimes": talpa.RetryTimes(res.Context)}).Warnln("获取帖子楼层失败")
 		return *plr, false
 	}
 	entry.WithFields(logrus.Fields{
@@ -82,23 +336,28 @@ func (t *TiebaSpider) handlePostList(entry *logrus.Entry, res *gen.Response, hel
 		"Page":        plr.Page.CurrentPage,
 		"NumPostList": len(plr.PostList),
 	}).Debugln()
-	//helper.PutJob(ForumUpsert(plr.Forum))
-	if len(plr.UserList) > 0 {
-		helper.PutJob(UserUpsert(plr.UserList...))
-	}
-	postList := make([]tieba.Post, len(plr.PostList))
-	subpostList := make([]tieba.SubPost, 0, len(plr.PostList))
-	for i, p := range plr.PostList {
-		postList[i] = p.Post
-		subpostList = append(subpostList, p.SubPostList...)
-	}
-	helper.PutJob(PostUpsert(postList...))
-	if len(subpostList) > 0 {
-		helper.PutJob(SubPostUpsert(subpostList...))
+	atomic.StoreInt64(&t.lastPostList, time.Now().UnixNano())
+	//helper.PutItem(plr.Forum)
+	putUsers(helper, plr.UserList)
+	items := make([]talpa.Item, 0, len(plr.PostList))
+	for _, p := range plr.PostList {
+		items = append(items, p.Post)
+		for _, sp := range p.SubPostList {
+			items = append(items, sp)
+		}
 	}
+	helper.PutItem(items...)
 	return *plr, true
 }
 
+func putUsers(helper talpa.Helper, users []tieba.User) {
+	items := make([]talpa.Item, len(users))
+	for i, user := range users {
+		items[i] = user
+	}
+	helper.PutItem(items...)
+}
+
 // 解析第一页回帖, 生成后序的请求
 func (t *TiebaSpider) ParsePostListPage(res *gen.Response, helper talpa.Helper) {
 	entry := t.logger.WithField("CallBack", "ParsePostListPage")
@@ -106,13 +365,21 @@ func (t *TiebaSpider) ParsePostListPage(res *gen.Response, helper talpa.Helper)
 	if !ok {
 		return
 	}
+	totalPage := plr.Page.TotalPage
+	if t.maxPages > 0 && totalPage > t.maxPages {
+		totalPage = t.maxPages
+	}
+	if totalPage < 1 {
+		totalPage = 1
+	}
+	refetch := t.threadPagesStarted(plr.Thread.ID, totalPage-1)
 	// 第一页已经得到了
-	reqNum := plr.Page.TotalPage - 1
-	reqs := make([]*gen.Request, reqNum)
-	for i := 2; i <= plr.Page.TotalPage; i++ {
-		req := tieba.PostListRequest(plr.Thread.ID, i, t.plrn, true)
-		req.Context.Set("CallBack", t.ParsePostList)
-		reqs[i-2] = req
+	reqs := make([]*gen.Request, 0, totalPage)
+	for i := 2; i <= totalPage; i++ {
+		req := tieba.PostListRequest(plr.Thread.ID, i, t.plrn, t.withSubPost)
+		// 重新抓取有更新的帖子时后续的页也需要跳过去重
+		t.prepare(req, t.ParsePostList).DontFilter = refetch
+		reqs = append(reqs, req)
 	}
 	helper.PutRequest(reqs...)
 }
@@ -120,5 +387,7 @@ func (t *TiebaSpider) ParsePostListPage(res *gen.Response, helper talpa.Helper)
 // 解析后续回帖
 func (t *TiebaSpider) ParsePostList(res *gen.Response, helper talpa.Helper) {
 	entry := t.logger.WithField("CallBack", "ParsePostList")
-	t.handlePostList(entry, res, helper)
+	if plr, ok := t.handlePostList(entry, res, helper); ok {
+		t.threadPageParsed(plr.Thread.ID)
+	}
 }
@@ -68,6 +68,12 @@ func sign(v url.Values) (string, string) {
 	return buf.String(), sign
 }
 
+// 请求的接口类别, 设置在请求 Context 的 "Endpoint" 中, 用于按接口限速
+const (
+	EndpointThreadList = "tieba/thread_list"
+	EndpointPostList   = "tieba/post_list"
+)
+
 const MaxThreadNum = 100
 
 // 获取帖子列表
@@ -84,10 +90,11 @@ func ThreadListRequest(kw string, pn int, rn int) *gen.Request {
 	v.Set("rn", strconv.Itoa(rn))
 	q, _ := sign(v)
 
-	req := DefaultRequest.Clone()
+	req := newRequest()
 	req.Method(method)
 	req.URL(urlStr)
 	req.BodyString(q)
+	req.Context.Set("Endpoint", EndpointThreadList)
 	return req
 }
 
@@ -115,10 +122,11 @@ func PostListRequest(tid string, pn int, rn int, withSubPost bool) *gen.Request
 	}
 	q, _ := sign(v)
 
-	req := DefaultRequest.Clone()
+	req := newRequest()
 	req.Method(method)
 	req.URL(urlStr)
 	req.BodyString(q)
+	req.Context.Set("Endpoint", EndpointPostList)
 	return req
 }
 
@@ -4,9 +4,12 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/go-tgod/tgod/http"
+	gen "gopkg.in/h2non/gentleman.v2"
 )
 
 var dir = path.Join(os.TempDir(), http.DefaultDumpDir)
@@ -23,6 +26,31 @@ func init() {
 	Logger.WithField("ContentDir", dir).Infoln("Content dir was created")
 }
 
+// 并发生成并修改请求, 请求之间以及与 DefaultRequest 之间不能共享请求头
+func TestRequestHeaderCopied(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				for _, req := range []*gen.Request{ThreadListRequest("kw", j, 1), PostListRequest("1", j, 2, true)} {
+					// 请求头在 "request" 阶段的插件中写入
+					req.SetHeader("X-Test", strconv.Itoa(i))
+					if ctx := req.Middleware.Run("request", req.Context); ctx.Error != nil {
+						t.Error(ctx.Error)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if v := DefaultRequest.Context.Request.Header.Get("X-Test"); v != "" {
+		t.Errorf("Header of DefaultRequest was modified: X-Test=%s", v)
+	}
+}
+
 func TestClient_GetThreadList(t *testing.T) {
 	tldir := path.Join(dir, "tl")
 	for i, tt := range []struct {
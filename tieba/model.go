@@ -18,16 +18,16 @@ type ResponseStatus struct {
 
 func (status ResponseStatus) String() string {
 	if status.ErrorCode == 0 {
-		return fmt.Sprintf("Success %s: %s", status.ErrorCode, status.ErrorMsg)
+		return fmt.Sprintf("Success %d: %s", status.ErrorCode, status.ErrorMsg)
 	}
-	return fmt.Sprintf("Error %s: %s", status.ErrorCode, status.ErrorMsg)
+	return fmt.Sprintf("Error %d: %s", status.ErrorCode, status.ErrorMsg)
 }
 
 func (status ResponseStatus) CheckStatus() error {
 	if status.ErrorCode == 0 {
 		return nil
 	}
-	return fmt.Errorf("Error %s: %s", status.ErrorCode, status.ErrorMsg)
+	return fmt.Errorf("Error %d: %s", status.ErrorCode, status.ErrorMsg)
 }
 
 type Forum struct {
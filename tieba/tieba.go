@@ -11,3 +11,10 @@ func init() {
 	DefaultRequest = gen.NewRequest()
 	DefaultRequest.SetHeader("User-Agent", "bdtb for Android "+ClientVersion)
 }
+
+// 复制 DefaultRequest 生成新请求, gentleman 的 Clone 与原请求共享请求头, 这里复制一份避免并发修改同一个 map
+func newRequest() *gen.Request {
+	req := DefaultRequest.Clone()
+	req.Context.Request.Header = req.Context.Request.Header.Clone()
+	return req
+}
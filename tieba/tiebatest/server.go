@@ -0,0 +1,213 @@
+// 模拟贴吧数据接口的 HTTP 服务器, 返回合成的帖子列表和回帖列表, 用于离线测试和性能测试
+package tiebatest
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 合成数据的规模和服务器的响应延迟
+type Options struct {
+	// 每个贴吧帖子列表返回的帖子数量, 不超过请求的 rn
+	Threads int
+	// 每个帖子的回帖页数
+	Pages int
+	// 每页回帖的楼层数量, 不超过请求的 rn
+	Posts int
+	// 请求带上楼中楼时每个楼层的楼中楼数量
+	SubPosts int
+	// 每个请求的响应延迟
+	Latency time.Duration
+}
+
+type Server struct {
+	*httptest.Server
+	opts        Options
+	numRequests int64
+
+	// 相同请求的响应内容总是相同的, 缓存编码后的响应使服务器本身的开销不影响性能测试的结果
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+// 启动模拟服务器, 使用 Redirect 将贴吧接口的请求发送到这个服务器
+func NewServer(opts Options) *Server {
+	s := &Server{opts: opts, cache: make(map[string][]byte)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/c/f/frs/page", s.handler(s.threadList))
+	mux.HandleFunc("/c/f/pb/page", s.handler(s.postList))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// 服务器收到的请求数量
+func (s *Server) NumRequests() int64 {
+	return atomic.LoadInt64(&s.numRequests)
+}
+
+// 将请求发送到模拟服务器, 保留原来的路径和参数
+func (s *Server) Redirect(req *gen.Request) *gen.Request {
+	return req.BaseURL(s.URL)
+}
+
+// 完整抓取一个贴吧需要的请求数量, 包括一个帖子列表请求和每个帖子的所有回帖页
+func (s *Server) RequestsPerForum() int {
+	return 1 + s.opts.Threads*s.opts.Pages
+}
+
+// 贴吧客户端的请求没有设置 Content-Type, 需要直接解析请求体中的参数
+func (s *Server) handler(build func(form url.Values) map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.numRequests, 1)
+		time.Sleep(s.opts.Latency)
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		key := r.URL.Path + "?" + string(body)
+		s.mu.Lock()
+		data, ok := s.cache[key]
+		s.mu.Unlock()
+		if !ok {
+			form, err := url.ParseQuery(string(body))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			v := build(form)
+			v["error_code"] = "0"
+			v["error_msg"] = ""
+			if data, err = json.Marshal(v); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.mu.Lock()
+			s.cache[key] = data
+			s.mu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+func formInt(form url.Values, key string, def int) int {
+	if i, err := strconv.Atoi(form.Get(key)); err == nil {
+		return i
+	}
+	return def
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// 同一贴吧的 ID 总是相同的, 不同贴吧的帖子 ID 不会重复
+func forumID(kw string) int {
+	h := fnv.New32a()
+	h.Write([]byte(kw))
+	return int(h.Sum32() % 1000000)
+}
+
+func page(current, total, size int) map[string]interface{} {
+	return map[string]interface{}{
+		"page_size":    strconv.Itoa(size),
+		"total_page":   strconv.Itoa(total),
+		"current_page": strconv.Itoa(current),
+		"has_more":     strconv.FormatBool(current < total),
+		"has_prev":     strconv.FormatBool(current > 1),
+	}
+}
+
+func users(n int) []map[string]interface{} {
+	list := make([]map[string]interface{}, n)
+	for i := range list {
+		id := strconv.Itoa(i + 1)
+		list[i] = map[string]interface{}{"id": id, "name_show": "user" + id, "portrait": "portrait" + id}
+	}
+	return list
+}
+
+func content(text string) []map[string]interface{} {
+	return []map[string]interface{}{{"type": "0", "text": text}}
+}
+
+// 所有帖子和楼层的时间都是固定的, 重新获取帖子列表时帖子没有更新
+var baseTime = time.Date(2017, 3, 28, 0, 0, 0, 0, time.UTC).Unix()
+
+func (s *Server) threadList(form url.Values) map[string]interface{} {
+	kw := form.Get("kw")
+	fid := forumID(kw)
+	n := min(s.opts.Threads, formInt(form, "rn", s.opts.Threads))
+	threads := make([]map[string]interface{}, n)
+	for i := range threads {
+		id := strconv.Itoa(fid*10000 + i)
+		threads[i] = map[string]interface{}{
+			"id":            id,
+			"tid":           id,
+			"title":         "thread " + id,
+			"reply_num":     strconv.Itoa(s.opts.Pages * s.opts.Posts),
+			"create_time":   strconv.FormatInt(baseTime, 10),
+			"last_time_int": strconv.FormatInt(baseTime+int64(i), 10),
+			"author_id":     "1",
+			"view_num":      "100",
+		}
+	}
+	return map[string]interface{}{
+		"forum":       map[string]interface{}{"id": strconv.Itoa(fid), "name": kw, "is_exists": "1"},
+		"page":        page(formInt(form, "pn", 1), 1, n),
+		"thread_list": threads,
+		"user_list":   users(5),
+	}
+}
+
+func (s *Server) postList(form url.Values) map[string]interface{} {
+	tid := form.Get("kz")
+	pn := formInt(form, "pn", 1)
+	n := min(s.opts.Posts, formInt(form, "rn", s.opts.Posts))
+	withFloor := form.Get("with_floor") == "1"
+	posts := make([]map[string]interface{}, n)
+	for i := range posts {
+		floor := (pn-1)*n + i + 1
+		id := tid + "-" + strconv.Itoa(floor)
+		subPosts := []map[string]interface{}{}
+		if withFloor {
+			for j := 0; j < s.opts.SubPosts; j++ {
+				subPosts = append(subPosts, map[string]interface{}{
+					"id":        id + "-" + strconv.Itoa(j+1),
+					"author_id": "2",
+					"floor":     strconv.Itoa(j + 1),
+					"time":      strconv.FormatInt(baseTime, 10),
+					"content":   content("sub post"),
+				})
+			}
+		}
+		posts[i] = map[string]interface{}{
+			"id":            id,
+			"author_id":     "1",
+			"floor":         strconv.Itoa(floor),
+			"time":          strconv.FormatInt(baseTime, 10),
+			"content":       content("post " + id),
+			"sub_post_list": subPosts,
+		}
+	}
+	return map[string]interface{}{
+		"thread":    map[string]interface{}{"id": tid, "title": "thread " + tid},
+		"page":      page(pn, s.opts.Pages, n),
+		"post_list": posts,
+		"user_list": users(5),
+	}
+}
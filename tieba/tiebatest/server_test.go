@@ -0,0 +1,45 @@
+package tiebatest
+
+import (
+	"testing"
+
+	"github.com/go-tgod/tgod/tieba"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer(Options{Threads: 3, Pages: 2, Posts: 4, SubPosts: 2})
+	defer s.Close()
+
+	res, err := s.Redirect(tieba.ThreadListRequest("test", 1, 50)).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlr := new(tieba.ThreadListResponse)
+	if err := res.JSON(tlr); err != nil {
+		t.Fatal(err)
+	}
+	if err := tlr.CheckStatus(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tlr.ThreadList) != 3 || tlr.Forum.Name != "test" {
+		t.Fatalf("%d threads of %q, 3 threads of test expected", len(tlr.ThreadList), tlr.Forum.Name)
+	}
+
+	res, err = s.Redirect(tieba.PostListRequest(tlr.ThreadList[0].ID, 2, 30, true)).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plr := new(tieba.PostListResponse)
+	if err := res.JSON(plr); err != nil {
+		t.Fatal(err)
+	}
+	if plr.Page.TotalPage != 2 || plr.Page.CurrentPage != 2 || len(plr.PostList) != 4 {
+		t.Fatalf("Unexpected page %+v with %d posts", plr.Page, len(plr.PostList))
+	}
+	if p := plr.PostList[0]; p.Floor != 5 || p.ThreadID != tlr.ThreadList[0].ID || len(p.SubPostList) != 2 {
+		t.Errorf("Unexpected post %+v", p)
+	}
+	if s.NumRequests() != 2 || s.RequestsPerForum() != 7 {
+		t.Errorf("NumRequests=%d RequestsPerForum=%d", s.NumRequests(), s.RequestsPerForum())
+	}
+}
@@ -0,0 +1,71 @@
+package tgod
+
+import (
+	"testing"
+
+	"github.com/go-tgod/tgod/talpa"
+	"github.com/go-tgod/tgod/tieba/tiebatest"
+	gen "gopkg.in/h2non/gentleman.v2"
+)
+
+// 依次发送请求并执行回调, skip 返回 true 的请求只发送不解析, 模拟解析失败. 返回所有请求和回调产生的请求
+func crawlThreads(t *testing.T, srv *tiebatest.Server, reqs []*gen.Request, skip func(i int) bool) []*gen.Request {
+	h := &sequentialHelper{reqs: reqs, stats: talpa.NewStats()}
+	var all []*gen.Request
+	for i := 0; len(h.reqs) > 0; i++ {
+		req := h.reqs[0]
+		h.reqs = h.reqs[1:]
+		all = append(all, req)
+		res, err := srv.Redirect(req).Do()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !skip(i) {
+			talpa.MetaOf(req).CallBack(res, h)
+		}
+	}
+	return all
+}
+
+func TestTiebaSpiderRepoll(t *testing.T) {
+	defer quietLoggers()()
+	srv := tiebatest.NewServer(benchOptions)
+	defer srv.Close()
+	spider := benchSpiders()[0]
+
+	// 第一个帖子的第一页模拟重试过的请求, 最后一个请求(最后一个帖子的最后一页)解析失败
+	reqs := spider.StartRequests()
+	total := srv.RequestsPerForum()
+	h := &sequentialHelper{stats: talpa.NewStats()}
+	res, err := srv.Redirect(reqs[0]).Do()
+	if err != nil {
+		t.Fatal(err)
+	}
+	talpa.MetaOf(reqs[0]).CallBack(res, h)
+	talpa.MetaOf(h.reqs[0]).DontFilter = true
+	all := crawlThreads(t, srv, h.reqs, func(i int) bool { return i == total-2 })
+	if len(all) != total-1 {
+		t.Fatalf("%d post list requests, %d expected", len(all), total-1)
+	}
+	for _, req := range all[1:] {
+		if talpa.MetaOf(req).DontFilter {
+			t.Fatal("Pages of a new thread should not skip the dupe filter")
+		}
+	}
+
+	// 再次获取帖子列表时只重新抓取解析失败的帖子, 并且所有页都跳过去重
+	all = crawlThreads(t, srv, spider.StartRequests(), func(int) bool { return false })
+	if len(all) != 1+benchOptions.Pages {
+		t.Fatalf("%d requests on repoll, %d expected", len(all), 1+benchOptions.Pages)
+	}
+	for _, req := range all[1:] {
+		if !talpa.MetaOf(req).DontFilter {
+			t.Fatal("Pages of a refetched thread should skip the dupe filter")
+		}
+	}
+
+	// 所有帖子都抓取完成后没有需要更新的帖子
+	if all = crawlThreads(t, srv, spider.StartRequests(), func(int) bool { return false }); len(all) != 1 {
+		t.Fatalf("%d requests after all threads were fetched, 1 expected", len(all))
+	}
+}